@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// httpAdapter is an ipp.Adapter equivalent to ipp.HttpAdapter, but with its
+// own request encoder so that attribute types go-ipp cannot encode (such as
+// collections) can be sent.
+type httpAdapter struct {
+	mu   sync.RWMutex
+	host string
+	port int
+	// path, when set, replaces the namespace/object part of every URI. It is
+	// used for printers advertising a single resource path such as ipp/print.
+	path string
+	// queue, when set, is the printer a redirect or re-resolve moved the
+	// queue to. It replaces the printer name in the URIs of printer requests.
+	queue string
+
+	username string
+	password string
+	useTLS   bool
+	client   *http.Client
+
+	// followRedirects makes HTTP redirects and IPP redirection statuses move
+	// the adapter to the new printer location.
+	followRedirects bool
+
+	// resolve, when set, is called after a connection failure to look the
+	// printer up again for subsequent requests.
+	resolve func() (mdnsTarget, error)
+
+	// socket, when set, is the Unix domain socket every connection is made
+	// to instead of host:port, e.g. /var/run/cups/cups.sock.
+	socket string
+
+	// proxy, when set, is the proxy every request is sent through.
+	proxy *neturl.URL
+
+	// warnings are the warning statuses of job requests not yet taken.
+	warnings []ippWarning
+
+	// version is the IPP version requests are sent with, and autoDowngrade
+	// lowers it to 1.1 when the printer rejects it.
+	version       ippVersion
+	autoDowngrade bool
+}
+
+// ippVersion is an IPP protocol version such as 2.0.
+type ippVersion struct {
+	major, minor int8
+}
+
+func (v ippVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// ippVersion11 is the oldest version still in use, spoken by every printer.
+var ippVersion11 = ippVersion{1, 1}
+
+// parseIppVersion parses the PRINTER_IPP_VERSION values 1.1, 2.0 and 2.1.
+func parseIppVersion(s string) (ippVersion, error) {
+	for _, v := range []ippVersion{ippVersion11, {2, 0}, {2, 1}} {
+		if v.String() == s {
+			return v, nil
+		}
+	}
+
+	return ippVersion{}, fmt.Errorf("invalid PRINTER_IPP_VERSION %q, expected 1.1, 2.0 or 2.1", s)
+}
+
+func newHttpAdapter(host string, port int, username, password string, useTLS bool) *httpAdapter {
+	h := &httpAdapter{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		useTLS:   useTLS,
+		version:  ippVersion{ipp.ProtocolVersionMajor, ipp.ProtocolVersionMinor},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+	}
+
+	// redirects are handled by SendRequest when followRedirects is set, as
+	// the request body cannot be replayed by the http.Client
+	h.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		if h.followRedirects {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+
+	return h
+}
+
+// useClientCert loads a certificate and key presented to printers that
+// require mutual TLS. It fails when either file is invalid or they do not
+// belong together.
+func (h *httpAdapter) useClientCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS client certificate: %w", err)
+	}
+
+	h.client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// limitConns caps the number of connections kept open to the printer at
+// max. Requests beyond the limit wait for a free connection, so any number
+// of callers (poll workers, pool submissions) share the same max.
+func (h *httpAdapter) limitConns(max int) {
+	t := h.client.Transport.(*http.Transport)
+	t.MaxConnsPerHost = max
+	t.MaxIdleConnsPerHost = max
+}
+
+// useProxy sends every request through the proxy at raw, an http://,
+// https:// or socks5:// URL. It takes precedence over HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY, which are honored otherwise. It cannot be
+// combined with useSocket.
+func (h *httpAdapter) useProxy(raw string) error {
+	if h.socket != "" {
+		return errors.New("a proxy cannot be used with a Unix domain socket")
+	}
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("invalid proxy URL %q, expected an http, https or socks5 scheme", raw)
+	}
+
+	h.client.Transport.(*http.Transport).Proxy = http.ProxyURL(u)
+	h.proxy = u
+	return nil
+}
+
+// useSocket makes the adapter connect to the Unix domain socket at path,
+// bypassing the proxy environment variables. URIs keep using host and port,
+// which CUPS only checks as the Host header. It cannot be combined with
+// useProxy.
+func (h *httpAdapter) useSocket(path string) error {
+	if h.proxy != nil {
+		return errors.New("a Unix domain socket cannot be used with a proxy")
+	}
+	h.socket = path
+	h.client.Transport.(*http.Transport).Proxy = nil
+	h.client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return nil
+}
+
+func (h *httpAdapter) SendRequest(url string, req *ipp.Request, additionalResponseData io.Writer) (*ipp.Response, error) {
+	return h.sendRequest(url, req, additionalResponseData, 0)
+}
+
+// maxRedirects bounds how many redirects a single request follows.
+const maxRedirects = 3
+
+func (h *httpAdapter) sendRequest(url string, req *ipp.Request, additionalResponseData io.Writer, redirects int) (*ipp.Response, error) {
+	h.mu.RLock()
+	version, queue := h.version, h.queue
+	h.mu.RUnlock()
+	req.ProtocolVersionMajor, req.ProtocolVersionMinor = version.major, version.minor
+
+	if uri, ok := req.OperationAttributes[ipp.AttributePrinterURI].(string); ok && queue != "" && strings.HasPrefix(uri, printerURIPrefix) {
+		req.OperationAttributes[ipp.AttributePrinterURI] = printerURIPrefix + queue
+	}
+
+	payload, err := encodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(payload)
+	var body io.Reader
+	if req.File != nil && req.FileSize != -1 {
+		size += req.FileSize
+		body = io.MultiReader(bytes.NewBuffer(payload), req.File)
+	} else {
+		body = bytes.NewBuffer(payload)
+	}
+
+	httpReq, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.ContentLength = int64(size)
+	httpReq.Header.Set("Content-Length", strconv.Itoa(size))
+	httpReq.Header.Set("Content-Type", ipp.ContentTypeIPP)
+
+	if h.username != "" && h.password != "" {
+		httpReq.SetBasicAuth(h.username, h.password)
+	}
+
+	httpResp, err := h.client.Do(httpReq)
+	if err != nil {
+		h.reresolve()
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if h.followRedirects && httpResp.StatusCode >= 300 && httpResp.StatusCode < 400 {
+		loc, err := httpResp.Location()
+		if err != nil {
+			return nil, err
+		}
+		return h.redirect(loc.String(), req, additionalResponseData, redirects)
+	}
+
+	if httpResp.StatusCode != 200 {
+		return nil, ipp.HTTPError{
+			Code: httpResp.StatusCode,
+		}
+	}
+
+	// buffer response to avoid read issues
+	buf := new(bytes.Buffer)
+	if httpResp.ContentLength > 0 {
+		buf.Grow(int(httpResp.ContentLength))
+	}
+	if _, err := io.Copy(buf, httpResp.Body); err != nil {
+		return nil, fmt.Errorf("unable to buffer response: %w", err)
+	}
+
+	var unsupported []string
+	if b := buf.Bytes(); len(b) >= 4 && binary.BigEndian.Uint16(b[2:]) != uint16(ipp.StatusOk) {
+		stripped, names, err := splitUnsupportedGroup(b)
+		if err != nil {
+			return nil, err
+		}
+		buf, unsupported = bytes.NewBuffer(stripped), names
+	}
+
+	ippResp, err := ipp.NewResponseDecoder(buf).Decode(additionalResponseData)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.followRedirects && (ippResp.StatusCode == ipp.StatusRedirectionOtherSite || ippResp.StatusCode == ipp.StatusCupsSeeOther) {
+		for _, name := range []string{ipp.AttributePrinterURI, attributePrinterURISupported} {
+			if v := ippResp.OperationAttributes[name]; len(v) > 0 {
+				if loc, ok := v[0].Value.(string); ok {
+					return h.redirect(loc, req, additionalResponseData, redirects)
+				}
+			}
+		}
+	}
+
+	if ippResp.StatusCode == ipp.StatusErrorVersionNotSupported && version != ippVersion11 {
+		if !h.autoDowngrade {
+			log.Printf("Printer does not support IPP %s, set PRINTER_IPP_VERSION=1.1 or PRINTER_IPP_AUTO_DOWNGRADE=true\n", version)
+		} else {
+			log.Printf("Printer does not support IPP %s, downgrading to %s\n", version, ippVersion11)
+			h.mu.Lock()
+			h.version = ippVersion11
+			h.mu.Unlock()
+
+			// like redirects, a consumed document stream cannot be sent
+			// again; the caller's next attempt uses the lower version
+			if req.File == nil {
+				return h.sendRequest(url, req, additionalResponseData, redirects)
+			}
+		}
+	}
+
+	if ippResp.StatusCode > ipp.StatusOk && ippResp.StatusCode <= maxIppStatusOk {
+		w := ippWarning{status: ippResp.StatusCode, unsupported: unsupported}
+		log.Printf("WARNING: %s\n", w)
+		h.recordWarning(req, w)
+		return ippResp, nil
+	}
+
+	if err = ippResp.CheckForErrors(); err != nil {
+		return nil, fmt.Errorf("received error IPP response: %w", err)
+	}
+
+	return ippResp, nil
+}
+
+const attributePrinterURISupported = "printer-uri-supported"
+
+// redirect points the adapter at loc for all subsequent requests. Requests
+// without a document are replayed at the new location right away; a
+// document stream has already been consumed, so those fail and are retried
+// by the caller.
+func (h *httpAdapter) redirect(loc string, req *ipp.Request, additionalResponseData io.Writer, redirects int) (*ipp.Response, error) {
+	u, err := neturl.Parse(loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect location %q: %w", loc, err)
+	}
+
+	t := mdnsTarget{host: u.Hostname(), path: strings.TrimPrefix(u.Path, "/")}
+	useTLS := u.Scheme == "https" || u.Scheme == "ipps"
+	if t.port, err = strconv.Atoi(u.Port()); err != nil {
+		t.port = 631
+		if u.Scheme == "http" {
+			t.port = 80
+		} else if u.Scheme == "https" {
+			t.port = 443
+		}
+	}
+
+	log.Printf("Printer moved to %s, following redirect\n", loc)
+	h.setTarget(t)
+	h.mu.Lock()
+	h.useTLS = useTLS
+	h.mu.Unlock()
+
+	if req.File != nil || redirects >= maxRedirects {
+		return nil, fmt.Errorf("printer redirected to %s", loc)
+	}
+
+	replay := h.GetHttpUri("", nil)
+	if strings.HasPrefix(t.path, "printers/") {
+		replay = h.GetHttpUri("printers", nil)
+	}
+
+	return h.sendRequest(replay, req, additionalResponseData, redirects+1)
+}
+
+// printerURIPrefix starts the printer-uri of requests for a printer, which
+// go-ipp builds from the printer name.
+const printerURIPrefix = "ipp://localhost/printers/"
+
+// setTarget points the adapter at a new printer location. A path such as
+// "printers/Office" names a queue, like in the mDNS setup, and only replaces
+// the printer of later printer requests instead of every URI.
+func (h *httpAdapter) setTarget(t mdnsTarget) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.host, h.port, h.path = t.host, t.port, t.path
+	if name, ok := strings.CutPrefix(t.path, "printers/"); ok && name != "" {
+		h.queue, h.path = strings.TrimSuffix(name, "/"), ""
+	}
+}
+
+// queueName returns the printer requests for name go to, which differs from
+// name after the queue was redirected.
+func (h *httpAdapter) queueName(name string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.queue != "" {
+		return h.queue
+	}
+
+	return name
+}
+
+func (h *httpAdapter) reresolve() {
+	if h.resolve == nil {
+		return
+	}
+
+	t, err := h.resolve()
+	if err != nil {
+		log.Printf("Failed to re-resolve printer: %s\n", err)
+		return
+	}
+
+	log.Printf("Re-resolved printer at %s:%d\n", t.host, t.port)
+	h.setTarget(t)
+}
+
+func (h *httpAdapter) GetHttpUri(namespace string, object interface{}) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	proto := "http"
+	if h.useTLS {
+		proto = "https"
+	}
+
+	uri := fmt.Sprintf("%s://%s", proto, net.JoinHostPort(h.host, strconv.Itoa(h.port)))
+
+	if h.path != "" {
+		return fmt.Sprintf("%s/%s", uri, strings.TrimPrefix(h.path, "/"))
+	}
+
+	if namespace != "" {
+		uri = fmt.Sprintf("%s/%s", uri, namespace)
+	}
+
+	if namespace == "printers" && h.queue != "" {
+		object = h.queue
+	}
+
+	if object != nil {
+		uri = fmt.Sprintf("%s/%v", uri, object)
+	}
+
+	return uri
+}
+
+func (h *httpAdapter) TestConnection() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	network, addr := "tcp", net.JoinHostPort(h.host, strconv.Itoa(h.port))
+	if h.socket != "" {
+		network, addr = "unix", h.socket
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return nil
+}
+
+// encodeRequest encodes req the same way ipp.Request.Encode does, except
+// that ippCollection values are written as IPP collections, ippRange values
+// as rangeOfInteger, and operation attributes passed as job attributes are
+// moved to the operation group.
+func encodeRequest(req *ipp.Request) ([]byte, error) {
+	routeOperationAttrs(req)
+	if doc, ok := req.File.(*jobDocument); ok {
+		maps.Copy(req.OperationAttributes, doc.attrs)
+	}
+
+	buf := new(bytes.Buffer)
+
+	header := []any{req.ProtocolVersionMajor, req.ProtocolVersionMinor, req.Operation, req.RequestId, ipp.TagOperation}
+	for _, v := range header {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	enc := ipp.NewAttributeEncoder(buf)
+	if err := enc.Encode(ipp.AttributeCharset, ipp.Charset); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(ipp.AttributeNaturalLanguage, ipp.CharsetLanguage); err != nil {
+		return nil, err
+	}
+	if err := encodeGroup(buf, req.OperationAttributes); err != nil {
+		return nil, err
+	}
+
+	groups := []struct {
+		tag   int8
+		attrs map[string]any
+	}{
+		{ipp.TagJob, req.JobAttributes},
+		{ipp.TagPrinter, req.PrinterAttributes},
+	}
+	for _, g := range groups {
+		if len(g.attrs) == 0 {
+			continue
+		}
+		if err := binary.Write(buf, binary.BigEndian, g.tag); err != nil {
+			return nil, err
+		}
+		if err := encodeGroup(buf, g.attrs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Write(buf, binary.BigEndian, ipp.TagEnd); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeGroup(buf *bytes.Buffer, attrs map[string]any) error {
+	for _, name := range sortedKeys(attrs) {
+		value := attrs[name]
+
+		if r, ok := value.(ippRange); ok {
+			b := binary.BigEndian.AppendUint32(nil, uint32(int32(r.lower)))
+			if err := writeTagged(buf, ipp.TagRange, name, binary.BigEndian.AppendUint32(b, uint32(int32(r.upper)))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		col, ok := value.(ippCollection)
+		if !ok {
+			if err := ipp.NewAttributeEncoder(buf).Encode(name, value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := writeTagged(buf, ipp.TagBeginCollection, name, nil); err != nil {
+			return err
+		}
+		if err := encodeCollectionMembers(buf, col); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeCollectionMembers writes the members of col followed by the
+// endCollection marker. Each member is a memberAttrName value carrying the
+// member name, followed by the member value with an empty name.
+func encodeCollectionMembers(buf *bytes.Buffer, col ippCollection) error {
+	for _, name := range sortedKeys(col) {
+		if err := writeTagged(buf, ipp.TagMemberName, "", []byte(name)); err != nil {
+			return err
+		}
+
+		switch v := col[name].(type) {
+		case ippCollection:
+			if err := writeTagged(buf, ipp.TagBeginCollection, "", nil); err != nil {
+				return err
+			}
+			if err := encodeCollectionMembers(buf, v); err != nil {
+				return err
+			}
+		case int:
+			tag, ok := ipp.AttributeTagMapping[name]
+			if !ok {
+				tag = ipp.TagInteger
+			}
+			if err := writeTagged(buf, tag, "", binary.BigEndian.AppendUint32(nil, uint32(int32(v)))); err != nil {
+				return err
+			}
+		case bool:
+			b := []byte{0}
+			if v {
+				b[0] = 1
+			}
+			if err := writeTagged(buf, ipp.TagBoolean, "", b); err != nil {
+				return err
+			}
+		case string:
+			tag, ok := ipp.AttributeTagMapping[name]
+			if !ok {
+				tag = ipp.TagKeyword
+			}
+			if err := writeTagged(buf, tag, "", []byte(v)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("type %T is not supported in collection member %s", v, name)
+		}
+	}
+
+	return writeTagged(buf, ipp.TagEndCollection, "", nil)
+}
+
+func writeTagged(buf *bytes.Buffer, tag int8, name string, value []byte) error {
+	if err := binary.Write(buf, binary.BigEndian, tag); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, int16(len(name))); err != nil {
+		return err
+	}
+	buf.WriteString(name)
+	if err := binary.Write(buf, binary.BigEndian, int16(len(value))); err != nil {
+		return err
+	}
+	buf.Write(value)
+
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
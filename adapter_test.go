@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// encodedAttr is an attribute value of an encoded request. Additional
+// values and collection members have an empty name.
+type encodedAttr struct {
+	group int8
+	tag   int8
+	name  string
+	value string
+}
+
+// decodeAttrs splits the attributes of the encoded request b.
+func decodeAttrs(t *testing.T, b []byte) []encodedAttr {
+	var attrs []encodedAttr
+	var group int8
+	for p := 8; p < len(b); {
+		tag := int8(b[p])
+		if tag == ipp.TagEnd {
+			return attrs
+		}
+		if tag < 0x10 {
+			group = tag
+			p++
+			continue
+		}
+
+		nameLen := int(binary.BigEndian.Uint16(b[p+1:]))
+		name := string(b[p+3 : p+3+nameLen])
+		p += 3 + nameLen
+		valueLen := int(binary.BigEndian.Uint16(b[p:]))
+		attrs = append(attrs, encodedAttr{group, tag, name, string(b[p+2 : p+2+valueLen])})
+		p += 2 + valueLen
+	}
+
+	t.Fatal("no end-of-attributes tag")
+	return nil
+}
+
+func int32Value(n ...int) string {
+	var b []byte
+	for _, v := range n {
+		b = binary.BigEndian.AppendUint32(b, uint32(int32(v)))
+	}
+
+	return string(b)
+}
+
+func TestEncodeRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		op   map[string]any
+		job  map[string]any
+		file io.Reader
+		// want is the attribute named like the first entry and the
+		// values following it
+		want []encodedAttr
+	}{
+		{
+			name: "keyword",
+			job:  map[string]any{attributeSides: "two-sided-long-edge"},
+			want: []encodedAttr{{ipp.TagJob, ipp.TagKeyword, attributeSides, "two-sided-long-edge"}},
+		},
+		{
+			name: "integer",
+			job:  map[string]any{ipp.AttributeCopies: 3},
+			want: []encodedAttr{{ipp.TagJob, ipp.TagInteger, ipp.AttributeCopies, int32Value(3)}},
+		},
+		{
+			name: "collection",
+			job: map[string]any{attributeMediaCol: ippCollection{
+				attributeMediaSource: "tray-1",
+				"media-size":         ippCollection{"x-dimension": 21000, "y-dimension": 29700},
+			}},
+			want: []encodedAttr{
+				{ipp.TagJob, ipp.TagBeginCollection, attributeMediaCol, ""},
+				{ipp.TagJob, ipp.TagMemberName, "", "media-size"},
+				{ipp.TagJob, ipp.TagBeginCollection, "", ""},
+				{ipp.TagJob, ipp.TagMemberName, "", "x-dimension"},
+				{ipp.TagJob, ipp.TagInteger, "", int32Value(21000)},
+				{ipp.TagJob, ipp.TagMemberName, "", "y-dimension"},
+				{ipp.TagJob, ipp.TagInteger, "", int32Value(29700)},
+				{ipp.TagJob, ipp.TagEndCollection, "", ""},
+				{ipp.TagJob, ipp.TagMemberName, "", attributeMediaSource},
+				{ipp.TagJob, ipp.TagKeyword, "", "tray-1"},
+				{ipp.TagJob, ipp.TagEndCollection, "", ""},
+			},
+		},
+		{
+			name: "operation attribute",
+			job:  map[string]any{ipp.AttributeJobName: "report.pdf"},
+			want: []encodedAttr{{ipp.TagOperation, ipp.TagName, ipp.AttributeJobName, "report.pdf"}},
+		},
+		{
+			name: "marked operation attribute",
+			job:  map[string]any{attributeJobAccountID: operationAttr{"acme"}},
+			want: []encodedAttr{{ipp.TagOperation, ipp.TagName, attributeJobAccountID, "acme"}},
+		},
+		{
+			name: "document attribute",
+			op:   map[string]any{ipp.AttributeJobID: 1},
+			file: withDocumentAttrs(strings.NewReader(testPDF), map[string]any{attributeDocumentLanguage: "th"}),
+			want: []encodedAttr{{ipp.TagOperation, ipp.TagLanguage, attributeDocumentLanguage, "th"}},
+		},
+		{
+			name: "range",
+			job:  map[string]any{attributePageRanges: ippRange{1, 5}},
+			want: []encodedAttr{{ipp.TagJob, ipp.TagRange, attributePageRanges, int32Value(1, 5)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := ipp.NewRequest(ipp.OperationCreateJob, 1)
+			for k, v := range tt.op {
+				req.OperationAttributes[k] = v
+			}
+			for k, v := range tt.job {
+				req.JobAttributes[k] = v
+			}
+			req.File = tt.file
+
+			b, err := encodeRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs := decodeAttrs(t, b)
+
+			start := slices.IndexFunc(attrs, func(a encodedAttr) bool { return a.name == tt.want[0].name })
+			if start < 0 {
+				t.Fatalf("%s not encoded in %v", tt.want[0].name, attrs)
+			}
+			got := attrs[start:min(start+len(tt.want), len(attrs))]
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("encoded %q, want %q", got, tt.want)
+			}
+			if n := bytes.Count(b, []byte(tt.want[0].name)); n != 1 {
+				t.Errorf("%s encoded %d times", tt.want[0].name, n)
+			}
+		})
+	}
+}
+
+// unstartedFakePrinter returns a fakePrinter whose server the caller
+// configures and starts. wrap, when set, wraps the handler of the printer.
+func unstartedFakePrinter(t *testing.T, wrap func(http.Handler) http.Handler) *fakePrinter {
+	p := &fakePrinter{httpStatus: make(map[int16]int), unsupported: make(map[int16][]string)}
+	var h http.Handler = http.HandlerFunc(p.serveHTTP)
+	if wrap != nil {
+		h = wrap(h)
+	}
+	p.srv = httptest.NewUnstartedServer(h)
+	t.Cleanup(p.srv.Close)
+
+	return p
+}
+
+// readPrinter sends a Get-Printer-Attributes request through a.
+func readPrinter(a *httpAdapter) error {
+	_, err := ipp.NewIPPClientWithAdapter("svc", a).GetPrinterAttributes("P", nil)
+	return err
+}
+
+// proxyPrinter returns a fakePrinter acting as an HTTP proxy, and the hosts
+// of the requests it got.
+func proxyPrinter(t *testing.T) (*fakePrinter, func() []string) {
+	var mu sync.Mutex
+	var hosts []string
+	p := unstartedFakePrinter(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hosts = append(hosts, r.Host)
+			mu.Unlock()
+			h.ServeHTTP(w, r)
+		})
+	})
+	p.srv.Start()
+
+	return p, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(hosts)
+	}
+}
+
+func TestAdapterProxy(t *testing.T) {
+	p, hosts := proxyPrinter(t)
+
+	a := newHttpAdapter("printer.invalid", 631, "", "", false)
+	if err := a.useProxy(p.srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := readPrinter(a); err != nil {
+		t.Fatalf("request through the proxy: %s", err)
+	}
+	if got := hosts(); !slices.Equal(got, []string{"printer.invalid:631"}) {
+		t.Errorf("proxy got requests for %v", got)
+	}
+
+	if err := a.useSocket(filepath.Join(t.TempDir(), "cups.sock")); err == nil {
+		t.Error("useSocket() with a proxy succeeded")
+	}
+	if err := newHttpAdapter("printer.invalid", 631, "", "", false).useProxy("ftp://proxy.invalid"); err == nil {
+		t.Error("useProxy() of an ftp URL succeeded")
+	}
+}
+
+func TestAdapterProxyEnv(t *testing.T) {
+	// the environment is read once per process, so the request is sent by
+	// a test process of its own
+	if os.Getenv("TEST_ADAPTER_PROXY_ENV") != "" {
+		if err := readPrinter(newHttpAdapter("printer.invalid", 631, "", "", false)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	p, hosts := proxyPrinter(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAdapterProxyEnv$")
+	cmd.Env = append(os.Environ(), "TEST_ADAPTER_PROXY_ENV=1", "HTTP_PROXY="+p.srv.URL, "http_proxy=", "NO_PROXY=", "no_proxy=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("request with HTTP_PROXY: %s\n%s", err, out)
+	}
+	if got := hosts(); !slices.Equal(got, []string{"printer.invalid:631"}) {
+		t.Errorf("proxy got requests for %v", got)
+	}
+}
+
+func TestAdapterSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cups.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := unstartedFakePrinter(t, nil)
+	p.srv.Listener.Close()
+	p.srv.Listener = l
+	p.srv.Start()
+
+	// the host is only the Host header
+	a := newHttpAdapter("printer.invalid", 631, "", "", false)
+	if err := a.useSocket(socket); err != nil {
+		t.Fatal(err)
+	}
+	if err := readPrinter(a); err != nil {
+		t.Fatalf("request over the socket: %s", err)
+	}
+	if n := len(p.received(ipp.OperationGetPrinterAttributes)); n != 1 {
+		t.Errorf("printer got %d requests, want 1", n)
+	}
+
+	if err := a.useProxy("http://proxy.invalid:3128"); err == nil {
+		t.Error("useProxy() with a socket succeeded")
+	}
+}
+
+// writeClientCert writes a self-signed certificate and its key, and returns
+// their files.
+func writeClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-ipp-file-print"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestAdapterClientCert(t *testing.T) {
+	p := unstartedFakePrinter(t, nil)
+	p.srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	p.srv.StartTLS()
+	u, err := url.Parse(p.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newHttpAdapter(u.Hostname(), port, "", "", true)
+	if err := readPrinter(a); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+
+	certFile, keyFile := writeClientCert(t)
+	if err := a.useClientCert(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	// other transport options keep the certificate
+	a.limitConns(1)
+	if err := readPrinter(a); err != nil {
+		t.Fatalf("request with a client certificate: %s", err)
+	}
+
+	if err := a.useClientCert(keyFile, certFile); err == nil {
+		t.Error("useClientCert() of swapped files succeeded")
+	}
+}
+
+func TestAdapterLimitConns(t *testing.T) {
+	var mu sync.Mutex
+	conns, active, maxActive := 0, 0, 0
+	p := unstartedFakePrinter(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			active++
+			maxActive = max(maxActive, active)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+			h.ServeHTTP(w, r)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+		})
+	})
+	p.srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	p.srv.Start()
+
+	a := p.adapter(t)
+	a.limitConns(2)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- readPrinter(a)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns > 2 || maxActive > 2 {
+		t.Errorf("printer saw %d connections and %d concurrent requests, want at most 2", conns, maxActive)
+	}
+}
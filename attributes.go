@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	attributeMediaCol             = "media-col"
+	attributeMediaSource          = "media-source"
+	attributeMediaSourceSupported = "media-source-supported"
+	attributeNumberUpSupported    = "number-up-supported"
+	attributeQueuedJobCount       = "queued-job-count"
+
+	// print-scaling (PWG 5100.13) controls how pages that do not match the
+	// selected media (media or media-col.media-size) are scaled onto it
+	attributePrintScaling          = "print-scaling"
+	attributePrintScalingSupported = "print-scaling-supported"
+
+	// job-account-id and job-accounting-user-id (PWG 5100.7) are job
+	// attributes used by printers with departmental cost accounting
+	attributeJobAccountID                 = "job-account-id"
+	attributeJobAccountIDSupported        = "job-account-id-supported"
+	attributeJobAccountingUserID          = "job-accounting-user-id"
+	attributeJobAccountingUserIDSupported = "job-accounting-user-id-supported"
+
+	// page-set is the CUPS option selecting odd or even pages, used for
+	// manual duplex on simplex printers. Note that documents are sent to the
+	// printer unmodified and page-set is a job attribute, which IPP has no
+	// per-document override for: CUPS applies it to every document of the
+	// job, so the one page img.png banner prints with odd and is skipped
+	// with even.
+	attributePageSet = "page-set"
+
+	// output-bin (PWG 5100.2) selects the sorter or mailbox bin, and is
+	// often combined with finishings such as stapling
+	attributeOutputBin          = "output-bin"
+	attributeOutputBinSupported = "output-bin-supported"
+
+	// print-content-optimize (PWG 5100.7) tells the printer what kind of
+	// content to optimize rendering for
+	attributePrintContentOptimize          = "print-content-optimize"
+	attributePrintContentOptimizeSupported = "print-content-optimize-supported"
+
+	// page-ranges selects the pages to print. CUPS applies it to each
+	// document of the job separately, so the one-page img.png banner still
+	// prints when only the first pages of the content are requested.
+	attributePageRanges = "page-ranges"
+
+	// sides selects one- or two-sided printing, and print-color-mode (PWG
+	// 5100.13) color or monochrome output
+	attributeSides          = "sides"
+	attributePrintColorMode = "print-color-mode"
+
+	// job-message-to-operator (PWG 5100.7) is shown on the operator panel,
+	// e.g. "pick up at front desk"; it is a text(MAX) of at most
+	// maxOperatorMessage octets
+	attributeJobMessageToOperator = "job-message-to-operator"
+	maxOperatorMessage            = 1023
+)
+
+// printScalingValues are the print-scaling keywords accepted in
+// PRINTER_PRINT_SCALING.
+var printScalingValues = []string{"auto", "auto-fit", "fill", "fit", "none"}
+
+// printContentOptimizeValues are the print-content-optimize keywords
+// accepted in PRINTER_CONTENT_OPTIMIZE.
+var printContentOptimizeValues = []string{"auto", "photo", "graphic", "text", "text-and-graphic"}
+
+// contentOptimizeFor returns the print-content-optimize value used for
+// documents of format when neither PRINTER_CONTENT_OPTIMIZE nor the sidecar
+// sets one: photo for images and text for plain text.
+func contentOptimizeFor(format string) string {
+	switch {
+	case format == "image/png" || format == "image/jpeg":
+		return "photo"
+	case strings.HasPrefix(format, "text/"):
+		return "text"
+	}
+
+	return ""
+}
+
+// capabilityAttrs are the printer attributes fetched by LoadCapabilities.
+var capabilityAttrs = []string{
+	attributeMediaSourceSupported,
+	attributeNumberUpSupported,
+	attributePrintScalingSupported,
+	attributeOutputBinSupported,
+	attributePrintContentOptimizeSupported,
+	attributeCompressionSupported,
+	attributeJobAccountIDSupported,
+	attributeJobAccountingUserIDSupported,
+	attributeIdentifyActionsSupported,
+}
+
+// ippCollection is an IPP collection value (RFC 8010, section 3.1.6). On
+// the wire a collection is not a flat value: it opens with a begCollection
+// tag carrying the attribute name, then every member is sent as a
+// memberAttrName value holding the member's name followed by the member's
+// own value with an empty name, and it closes with endCollection. Members
+// may themselves be collections, e.g. media-col.media-size.
+type ippCollection map[string]any
+
+// ippRange is an IPP rangeOfInteger value, such as a page-ranges entry.
+type ippRange struct {
+	lower, upper int
+}
+
+// operationAttr marks a value that belongs in the operation attribute group
+// of a job creation request rather than the job group.
+type operationAttr struct {
+	value any
+}
+
+// operationGroupAttrs lists the attributes that RFC 8011 defines as
+// operation attributes of Print-Job, Create-Job and Validate-Job. Setting
+// them as job attributes is silently ignored by most printers, so they are
+// moved to the operation group even when configured as job attributes.
+var operationGroupAttrs = map[string]bool{
+	ipp.AttributeRequestingUserName: true,
+	ipp.AttributeJobName:            true,
+	attributeJobImpressions:         true,
+	attributeJobKOctets:             true,
+	attributeJobMediaSheets:         true,
+	attributeIppAttributeFidelity:   true,
+}
+
+// documentOperationAttrs lists the operation attributes that RFC 8011 and
+// PWG 5100.13 define for Print-Job, Send-Document and Validate-Job but not
+// for Create-Job. Every job is sent as Create-Job and Send-Document, so
+// they are sent with the document they describe instead.
+var documentOperationAttrs = map[string]bool{
+	attributeDocumentPassword: true,
+	attributeDocumentLanguage: true,
+}
+
+// jobDocument is a document with Send-Document operation attributes of its
+// own, such as compression or document-password. The adapter sets them on
+// the request sending it, so other documents of the job, such as the
+// banner, are unaffected.
+type jobDocument struct {
+	io.Reader
+	attrs map[string]any
+}
+
+// withDocumentAttrs returns r sent with the Send-Document operation
+// attributes attrs, in addition to those it already carries.
+func withDocumentAttrs(r io.Reader, attrs map[string]any) io.Reader {
+	if len(attrs) == 0 {
+		return r
+	}
+	if doc, ok := r.(*jobDocument); ok {
+		merged := maps.Clone(doc.attrs)
+		maps.Copy(merged, attrs)
+		return &jobDocument{doc.Reader, merged}
+	}
+
+	return &jobDocument{r, attrs}
+}
+
+// jobUser returns the requesting-user-name set in ja, or an empty string
+// when the client's user is used.
+func jobUser(ja map[string]any) string {
+	v := ja[ipp.AttributeRequestingUserName]
+	if op, ok := v.(operationAttr); ok {
+		v = op.value
+	}
+	user, _ := v.(string)
+
+	return user
+}
+
+// documentAttrs removes the documentOperationAttrs from ja and returns
+// them.
+func documentAttrs(ja map[string]any) map[string]any {
+	attrs := make(map[string]any)
+	for k, v := range ja {
+		if !documentOperationAttrs[k] {
+			continue
+		}
+		if op, ok := v.(operationAttr); ok {
+			v = op.value
+		}
+		attrs[k] = v
+		delete(ja, k)
+	}
+
+	return attrs
+}
+
+const (
+	attributeJobImpressions       = "job-impressions"
+	attributeJobKOctets           = "job-k-octets"
+	attributeJobMediaSheets       = "job-media-sheets"
+	attributeIppAttributeFidelity = "ipp-attribute-fidelity"
+	attributeDocumentLanguage     = "document-natural-language"
+)
+
+// languageTag matches the RFC 5646 language tags accepted in
+// PRINTER_DOCUMENT_LANGUAGE, such as "th" or "en-us". IPP natural languages
+// are lower case.
+var languageTag = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+
+func init() {
+	ipp.AttributeTagMapping[attributeMediaCol] = ipp.TagBeginCollection
+	ipp.AttributeTagMapping[attributeMediaSource] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributePrintScaling] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributePageSet] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributeOutputBin] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributePrintContentOptimize] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributeCompression] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributeJobAccountID] = ipp.TagName
+	ipp.AttributeTagMapping[attributeJobAccountingUserID] = ipp.TagName
+	ipp.AttributeTagMapping[attributeJobImpressions] = ipp.TagInteger
+	ipp.AttributeTagMapping[attributeJobKOctets] = ipp.TagInteger
+	ipp.AttributeTagMapping[attributeJobMediaSheets] = ipp.TagInteger
+	ipp.AttributeTagMapping[attributeIppAttributeFidelity] = ipp.TagBoolean
+	ipp.AttributeTagMapping[attributeDocumentPassword] = ipp.TagString
+	ipp.AttributeTagMapping[attributeDocumentLanguage] = ipp.TagLanguage
+	ipp.AttributeTagMapping[attributeSides] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributePrintColorMode] = ipp.TagKeyword
+	ipp.AttributeTagMapping[attributeJobMessageToOperator] = ipp.TagText
+}
+
+// routeOperationAttrs moves operationAttr values and well-known operation
+// attributes out of the job group of req into its operation group.
+func routeOperationAttrs(req *ipp.Request) {
+	for k, v := range req.JobAttributes {
+		if op, ok := v.(operationAttr); ok {
+			req.OperationAttributes[k] = op.value
+			delete(req.JobAttributes, k)
+		} else if operationGroupAttrs[k] {
+			req.OperationAttributes[k] = v
+			delete(req.JobAttributes, k)
+		}
+	}
+}
+
+// loadSidecarAttrs reads the optional per-file job attribute overrides stored
+// next to file as "<file>.attrs.json". A missing sidecar is not an error.
+func loadSidecarAttrs(file string) (map[string]any, error) {
+	b, err := os.ReadFile(sidecarAttrsPath(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]any)
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		return nil, fmt.Errorf("invalid sidecar %s: %w", sidecarAttrsPath(file), err)
+	}
+
+	return normalizeAttrs(attrs), nil
+}
+
+func sidecarAttrsPath(file string) string {
+	return file + sidecarAttrsSuffix
+}
+
+const sidecarAttrsSuffix = ".attrs.json"
+
+// normalizeAttrs converts values decoded from JSON into types go-ipp can
+// encode: whole numbers become int and arrays become typed slices.
+func normalizeAttrs(attrs map[string]any) map[string]any {
+	for k, v := range attrs {
+		attrs[k] = normalizeValue(v)
+	}
+
+	return attrs
+}
+
+func normalizeValue(v any) any {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v)
+		}
+	case []any:
+		var ints []int
+		var strs []string
+		for _, e := range v {
+			switch e := normalizeValue(e).(type) {
+			case int:
+				ints = append(ints, e)
+			case string:
+				strs = append(strs, e)
+			}
+		}
+		if len(ints) == len(v) {
+			return ints
+		}
+		if len(strs) == len(v) {
+			return strs
+		}
+	case map[string]any:
+		col := make(ippCollection, len(v))
+		for mk, mv := range v {
+			col[mk] = normalizeValue(mv)
+		}
+		return col
+	}
+
+	return v
+}
+
+// sidecarFirstPagesKey is the sidecar entry overriding PRINTER_FIRST_N_PAGES
+// for one document, 0 printing every page. It is not a job attribute and
+// never sent to the printer.
+const sidecarFirstPagesKey = "first-n-pages"
+
+// applyFirstPages applies the page cap requested by the sidecar to ja and
+// removes the entry from sidecarAttrs.
+func applyFirstPages(ja, sidecarAttrs map[string]any) error {
+	v, ok := sidecarAttrs[sidecarFirstPagesKey]
+	if !ok {
+		return nil
+	}
+	delete(sidecarAttrs, sidecarFirstPagesKey)
+
+	n, ok := v.(int)
+	if !ok || n < 0 {
+		return fmt.Errorf("invalid %s %v in sidecar, expected a page count", sidecarFirstPagesKey, v)
+	}
+	if n == 0 {
+		delete(ja, attributePageRanges)
+	} else {
+		ja[attributePageRanges] = ippRange{1, n}
+	}
+
+	return nil
+}
+
+// truncateOperatorMessage shortens a job-message-to-operator in ja to
+// maxOperatorMessage octets without splitting a UTF-8 sequence.
+func truncateOperatorMessage(ja map[string]any) {
+	msg, ok := ja[attributeJobMessageToOperator].(string)
+	if !ok || len(msg) <= maxOperatorMessage {
+		return
+	}
+
+	n := maxOperatorMessage
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	log.Printf("%s is longer than %d octets, truncating\n", attributeJobMessageToOperator, maxOperatorMessage)
+	ja[attributeJobMessageToOperator] = msg[:n]
+}
+
+// applyMediaSource moves a flat "media-source" keyword (from the environment
+// or a sidecar) into the media-col collection where IPP expects it, keeping
+// any other media-col members already present.
+func (i IppPrinterManager) applyMediaSource(ja map[string]any) {
+	source, ok := ja[attributeMediaSource].(string)
+	delete(ja, attributeMediaSource)
+	if !ok || source == "" {
+		return
+	}
+
+	if !i.isSupported(attributeMediaSourceSupported, source) {
+		log.Printf("media-source %q is not supported by the printer, ignoring\n", source)
+		return
+	}
+
+	col, _ := ja[attributeMediaCol].(ippCollection)
+	col = maps.Clone(col)
+	if col == nil {
+		col = ippCollection{}
+	}
+	col[attributeMediaSource] = source
+	ja[attributeMediaCol] = col
+}
+
+// requireSupported removes ja[name] when the printer advertises
+// supportedAttr as false, i.e. it does not accept the attribute at all. It
+// reports whether the attribute was removed.
+func (i IppPrinterManager) requireSupported(ja map[string]any, name, supportedAttr string) bool {
+	if _, ok := ja[name]; !ok || i.isSupported(supportedAttr, true) {
+		return false
+	}
+
+	log.Printf("%s is not supported by the printer, ignoring\n", name)
+	delete(ja, name)
+
+	return true
+}
+
+// mediaSize is the PRINTER_MEDIA_COL shorthand for custom media. All
+// values are in hundredths of a millimetre.
+type mediaSize struct {
+	Width  int  `json:"width"`
+	Height int  `json:"height"`
+	Top    *int `json:"top"`
+	Bottom *int `json:"bottom"`
+	Left   *int `json:"left"`
+	Right  *int `json:"right"`
+}
+
+// parseMediaCol builds a media-col collection from PRINTER_MEDIA_COL. The
+// value is either the shorthand {"width":..,"height":..,"top":..} or a full
+// media-col object with IPP member names.
+func parseMediaCol(s string) (ippCollection, error) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("invalid PRINTER_MEDIA_COL: %w", err)
+	}
+	if _, ok := raw["width"]; !ok {
+		normalizeAttrs(raw)
+		return ippCollection(raw), nil
+	}
+
+	var m mediaSize
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, fmt.Errorf("invalid PRINTER_MEDIA_COL: %w", err)
+	}
+	if m.Width <= 0 || m.Height <= 0 {
+		return nil, fmt.Errorf("invalid PRINTER_MEDIA_COL: width and height must be positive")
+	}
+
+	col := ippCollection{
+		"media-size": ippCollection{"x-dimension": m.Width, "y-dimension": m.Height},
+	}
+	for name, v := range map[string]*int{
+		"media-top-margin":    m.Top,
+		"media-bottom-margin": m.Bottom,
+		"media-left-margin":   m.Left,
+		"media-right-margin":  m.Right,
+	} {
+		if v != nil {
+			col[name] = *v
+		}
+	}
+
+	return col, nil
+}
+
+// dropUnsupported removes ja[name] when the printer does not list its value
+// in supportedAttr, and reports whether it was removed.
+func (i IppPrinterManager) dropUnsupported(ja map[string]any, name, supportedAttr string) bool {
+	value, ok := ja[name]
+	if !ok || i.isSupported(supportedAttr, value) {
+		return false
+	}
+
+	log.Printf("%s %v is not supported by the printer, ignoring\n", name, value)
+	delete(ja, name)
+
+	return true
+}
+
+// isSupported reports whether value is listed in the printer's "*-supported"
+// attribute. When the printer does not advertise the attribute (or its
+// capabilities could not be fetched) every value is accepted.
+func (i IppPrinterManager) isSupported(supportedAttr string, value any) bool {
+	values := i.caps.get(supportedAttr)
+	if len(values) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(values, func(a ipp.Attribute) bool {
+		if r, ok := a.Value.([]int32); ok && len(r) == 2 {
+			n, ok := value.(int)
+			return ok && int32(n) >= r[0] && int32(n) <= r[1]
+		}
+		return a.Value == value
+	})
+}
+
+// operationOnlyAttrs are operation attributes that are managed by the client
+// itself. They are always dropped from configured job attributes.
+var operationOnlyAttrs = []string{
+	ipp.AttributeCharset,
+	ipp.AttributeNaturalLanguage,
+	ipp.AttributePrinterURI,
+	ipp.AttributeJobID,
+	ipp.AttributeJobURI,
+	ipp.AttributeDocumentFormat,
+	ipp.AttributeDocumentName,
+	ipp.AttributeLastDocument,
+}
+
+// attrFilter restricts which job attribute keys from the environment and
+// sidecars are submitted.
+type attrFilter struct {
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+// newAttrFilter builds a filter. An empty allowed list allows every key that
+// is not denied.
+func newAttrFilter(allowed, denied []string) attrFilter {
+	f := attrFilter{denied: make(map[string]bool)}
+	if len(allowed) > 0 {
+		f.allowed = make(map[string]bool)
+		for _, k := range allowed {
+			f.allowed[k] = true
+		}
+	}
+	for _, k := range append(operationOnlyAttrs, denied...) {
+		f.denied[k] = true
+	}
+
+	return f
+}
+
+// apply removes the attributes the filter does not let through from ja and
+// returns their names.
+func (f attrFilter) apply(ja map[string]any) []string {
+	var dropped []string
+	for k := range ja {
+		if f.denied[k] || (f.allowed != nil && !f.allowed[k]) {
+			log.Printf("Dropping job attribute %s\n", k)
+			delete(ja, k)
+			dropped = append(dropped, k)
+		}
+	}
+	slices.Sort(dropped)
+
+	return dropped
+}
+
+const (
+	formatAuto      = "auto"
+	formatExtension = "extension"
+)
+
+// extensionFormats maps printable file extensions to their document-format.
+var extensionFormats = map[string]string{
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".pwg":  "image/pwg-raster",
+	".pcl":  "application/vnd.hp-PCL",
+}
+
+// formatToken matches a document-format given in a file name as an
+// "@type-subtype" token at the end of the name or right before the
+// extension, for systems that cannot write sidecars:
+// "invoice@application-postscript.ps" is sent as application/postscript.
+// The type must be an IANA top-level media type, so names such as
+// "john@acme-corp.docx" are left alone. The first hyphen separates type and
+// subtype, and a trailing dotted part is only taken as the extension when it
+// has no hyphen, so "report@application-vnd.hp-PCL" names
+// application/vnd.hp-PCL.
+var formatToken = regexp.MustCompile(`@((?i:application|audio|font|haptics|image|message|model|multipart|text|video))-([A-Za-z0-9.+-]+?)(\.[A-Za-z0-9]+)?$`)
+
+// parseFormatToken returns the document-format named by a format token in
+// name and name with the token removed.
+func parseFormatToken(name string) (format, stripped string, ok bool) {
+	m := formatToken.FindStringSubmatchIndex(name)
+	if m == nil {
+		return "", name, false
+	}
+
+	// top-level types are case-insensitive and registered in lower case
+	format = strings.ToLower(name[m[2]:m[3]]) + "/" + name[m[4]:m[5]]
+	stripped = name[:m[0]]
+	if m[6] >= 0 {
+		stripped += name[m[6]:m[7]]
+	}
+
+	return format, stripped, true
+}
+
+// documentFormat resolves the document-format sent for a document named
+// name. A format token in the name always wins. Otherwise, in auto mode
+// every document is sent as application/octet-stream and the printer
+// detects the format; in extension mode it is derived from the file
+// extension.
+func (i IppPrinterManager) documentFormat(name string) string {
+	if format, _, ok := parseFormatToken(name); ok {
+		return format
+	}
+
+	if i.formatMode == formatExtension {
+		if f, ok := extensionFormats[strings.ToLower(filepath.Ext(name))]; ok {
+			return f
+		}
+	}
+
+	return ipp.MimeTypeOctetStream
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormatToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		stripped string
+	}{
+		{"invoice@application-postscript.ps", "application/postscript", "invoice.ps"},
+		{"report@application-vnd.hp-PCL", "application/vnd.hp-PCL", "report"},
+		{"report@application-vnd.hp-PCL.pcl", "application/vnd.hp-PCL", "report.pcl"},
+		{"sheet@application-vnd.ms-excel.xls", "application/vnd.ms-excel", "sheet.xls"},
+		{"scan@image-pwg-raster", "image/pwg-raster", "scan"},
+		{"scan@Application-pdf.pdf", "application/pdf", "scan.pdf"},
+		{"john@acme-corp.docx", "", "john@acme-corp.docx"},
+		{"plain.pdf", "", "plain.pdf"},
+	}
+	for _, tt := range tests {
+		format, stripped, ok := parseFormatToken(tt.name)
+		if format != tt.format || stripped != tt.stripped || ok != (tt.format != "") {
+			t.Errorf("parseFormatToken(%q) = %q, %q, %v, want %q, %q, %v", tt.name, format, stripped, ok, tt.format, tt.stripped, tt.format != "")
+		}
+	}
+}
+
+func TestDocumentFormat(t *testing.T) {
+	tests := []struct {
+		mode string
+		name string
+		want string
+	}{
+		{formatAuto, "a.pdf", "application/octet-stream"},
+		{formatAuto, "a@application-postscript.ps", "application/postscript"},
+		{formatExtension, "a.pdf", "application/pdf"},
+		{formatExtension, "a.JPG", "image/jpeg"},
+		{formatExtension, "a@image-pwg-raster.pdf", "image/pwg-raster"},
+	}
+	for _, tt := range tests {
+		m := IppPrinterManager{formatMode: tt.mode}
+		if got := m.documentFormat(tt.name); got != tt.want {
+			t.Errorf("documentFormat(%q) in %s mode = %q, want %q", tt.name, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeAttrs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want any
+	}{
+		{"whole number", 2.0, 2},
+		{"fraction", 1.5, 1.5},
+		{"integers", []any{1.0, 3.0}, []int{1, 3}},
+		{"keywords", []any{"staple", "punch"}, []string{"staple", "punch"}},
+		{"mixed", []any{1.0, "a"}, []any{1.0, "a"}},
+		{"collection", map[string]any{"x-dimension": 21000.0}, ippCollection{"x-dimension": 21000}},
+	}
+	for _, tt := range tests {
+		got := normalizeAttrs(map[string]any{"attr": tt.in})["attr"]
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: normalizeAttrs() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/phin1x/go-ipp"
+	"log"
+	"sync"
+	"time"
+)
+
+// capabilityCache holds the printer attributes fetched by LoadCapabilities.
+// It is shared by all copies of the manager so a refresh is seen by the
+// watcher.
+type capabilityCache struct {
+	mu    sync.RWMutex
+	attrs ipp.Attributes
+
+	// stale wakes the refresher ahead of its interval.
+	stale chan struct{}
+}
+
+func newCapabilityCache() *capabilityCache {
+	return &capabilityCache{stale: make(chan struct{}, 1)}
+}
+
+func (c *capabilityCache) get(name string) []ipp.Attribute {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.attrs[name]
+}
+
+func (c *capabilityCache) set(attrs ipp.Attributes) {
+	c.mu.Lock()
+	c.attrs = attrs
+	c.mu.Unlock()
+}
+
+// invalidate asks the refresher to fetch the capabilities again now.
+func (c *capabilityCache) invalidate() {
+	select {
+	case c.stale <- struct{}{}:
+	default:
+	}
+}
+
+// RefreshCapabilities reloads the printer capabilities every interval, and
+// right away after a job failed because of an attribute the printer no
+// longer supports, until ctx is done.
+func (i IppPrinterManager) RefreshCapabilities(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-i.caps.stale:
+		}
+
+		if err := i.LoadCapabilities(); err != nil {
+			log.Printf("Failed to refresh printer capabilities: %s\n", err)
+		}
+	}
+}
+
+// isCapabilityError reports whether the printer rejected a job because of
+// its attributes or document format.
+func isCapabilityError(err error) bool {
+	var ippErr ipp.IPPError
+	if !errors.As(err, &ippErr) {
+		return false
+	}
+
+	switch ippErr.Status {
+	case ipp.StatusErrorAttributesOrValues, ipp.StatusErrorConflicting, ipp.StatusErrorDocumentFormatNotSupported:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// checksumAlgos are the hashes accepted in PRINTER_CHECKSUM_ALGO.
+var checksumAlgos = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksum hashes r from its current position to the end with algo and
+// returns it as "<algo>:<hex>", leaving r where it was.
+func checksum(algo string, r io.ReadSeeker) (string, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+
+	h := checksumAlgos[algo]()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return algo + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"log"
+)
+
+const (
+	// compression (RFC 8011) is the Print-Job and Send-Document operation
+	// attribute naming the algorithm the document data is compressed with
+	attributeCompression          = "compression"
+	attributeCompressionSupported = "compression-supported"
+
+	compressionNone = "none"
+)
+
+// compress reads r to the end and returns its data compressed with
+// compression, either gzip or deflate.
+func compress(compression string, r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var w io.WriteCloser
+	if compression == "deflate" {
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compressionFor returns the compression to send documents with: the
+// configured one when the printer lists it in compression-supported, and
+// none otherwise.
+func (i IppPrinterManager) compressionFor() string {
+	if i.compression == compressionNone {
+		return compressionNone
+	}
+
+	for _, a := range i.caps.get(attributeCompressionSupported) {
+		if a.Value == i.compression {
+			return i.compression
+		}
+	}
+	log.Printf("WARNING: printer does not support %s compression, sending documents uncompressed\n", i.compression)
+
+	return compressionNone
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/caarlos0/env/v11"
+	"github.com/phin1x/go-ipp"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadConfig parses the environment. When PRINTER_CONFIG_FILE names a file
+// of KEY=VALUE lines, its entries override the process environment, which
+// lets settings be changed for a reload without restarting.
+func loadConfig() (config, error) {
+	vars := env.ToMap(os.Environ())
+
+	if p := vars["PRINTER_CONFIG_FILE"]; p != "" {
+		f, err := os.Open(p)
+		if err != nil {
+			return config{}, err
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return config{}, fmt.Errorf("invalid line in %s: %q", p, line)
+			}
+			vars[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		if err := sc.Err(); err != nil {
+			return config{}, err
+		}
+	}
+
+	return env.ParseAsWithOptions[config](env.Options{Environment: vars})
+}
+
+// jobSettings are the manager settings that can be changed at runtime. A
+// reload stores new settings instead of changing them in place.
+type jobSettings struct {
+	defaultJobAttrs map[string]any
+	operationAttrs  map[string]any
+	attrFilter      attrFilter
+
+	maxRemoteQueue int
+	moveRetries    int
+	busyRetry      time.Duration
+	errorBackoff   time.Duration
+
+	profiles       map[string]map[string]any
+	defaultProfile string
+}
+
+// reloadableEnv lists the variables applied by a reload. Changes to any
+// other variable only take effect after a restart, except for
+// PRINTER_POLL_WORKERS, which a reload applies while polling is enabled.
+var reloadableEnv = []string{
+	"PRINTER_JOB_ATTRS",
+	"PRINTER_OPERATION_ATTRS",
+	"PRINTER_MEDIA_SOURCE",
+	"PRINTER_MEDIA_COL",
+	"PRINTER_REVERSE_PAGES",
+	"PRINTER_PRINT_SCALING",
+	"PRINTER_CONTENT_OPTIMIZE",
+	"PRINTER_PAGE_PARITY",
+	"PRINTER_OUTPUT_BIN",
+	"PRINTER_NUMBER_UP",
+	"PRINTER_ATTRIBUTE_FIDELITY",
+	"PRINTER_DOCUMENT_LANGUAGE",
+	"PRINTER_FIRST_N_PAGES",
+	"PRINTER_OPERATOR_MESSAGE",
+	"PRINTER_PROFILES_FILE",
+	"PRINTER_PROFILE",
+	"PRINTER_JOB_ACCOUNT_ID",
+	"PRINTER_JOB_ACCOUNTING_USER_ID",
+	"PRINTER_ALLOWED_ATTRS",
+	"PRINTER_DENIED_ATTRS",
+	"PRINTER_MAX_REMOTE_QUEUE",
+	"PRINTER_BUSY_RETRY",
+	"PRINTER_ERROR_BACKOFF",
+	"PRINTER_MOVE_RETRIES",
+}
+
+// jobSettings builds the runtime settings from cfg.
+func (cfg config) jobSettings() (*jobSettings, error) {
+	jobAttrs := make(map[string]any)
+	if err := json.Unmarshal([]byte(cfg.IppJobAttrs), &jobAttrs); err != nil {
+		log.Printf("Failed to parse job attributes: %s\n", err)
+	}
+	normalizeAttrs(jobAttrs)
+	if cfg.IppMediaCol != "" {
+		col, err := parseMediaCol(cfg.IppMediaCol)
+		if err != nil {
+			return nil, err
+		}
+		jobAttrs[attributeMediaCol] = col
+	}
+	if cfg.IppMediaSrc != "" {
+		jobAttrs[attributeMediaSource] = cfg.IppMediaSrc
+	}
+	if cfg.IppReverse {
+		// CUPS "outputorder" option; a sidecar can set it back to "normal"
+		jobAttrs[ipp.AttributeOutputOrder] = "reverse"
+	}
+	if cfg.IppScaling != "" {
+		if !slices.Contains(printScalingValues, cfg.IppScaling) {
+			return nil, fmt.Errorf("invalid PRINTER_PRINT_SCALING %q, expected one of %s", cfg.IppScaling, strings.Join(printScalingValues, ", "))
+		}
+		jobAttrs[attributePrintScaling] = cfg.IppScaling
+	}
+	if cfg.IppOptimize != "" {
+		if !slices.Contains(printContentOptimizeValues, cfg.IppOptimize) {
+			return nil, fmt.Errorf("invalid PRINTER_CONTENT_OPTIMIZE %q, expected one of %s", cfg.IppOptimize, strings.Join(printContentOptimizeValues, ", "))
+		}
+		jobAttrs[attributePrintContentOptimize] = cfg.IppOptimize
+	}
+	switch cfg.IppParity {
+	case "", "all":
+	case "odd", "even":
+		jobAttrs[attributePageSet] = cfg.IppParity
+	default:
+		return nil, fmt.Errorf("invalid PRINTER_PAGE_PARITY %q, expected all, odd or even", cfg.IppParity)
+	}
+	if cfg.IppOutputBin != "" {
+		jobAttrs[attributeOutputBin] = cfg.IppOutputBin
+	}
+	if cfg.IppAccountID != "" {
+		jobAttrs[attributeJobAccountID] = cfg.IppAccountID
+	}
+	if cfg.IppAcctUser != "" {
+		jobAttrs[attributeJobAccountingUserID] = cfg.IppAcctUser
+	}
+	switch cfg.IppNumberUp {
+	case 0:
+	case 1, 2, 4, 6, 9:
+		jobAttrs[ipp.AttributeNumberUp] = cfg.IppNumberUp
+	default:
+		return nil, fmt.Errorf("invalid PRINTER_NUMBER_UP %d, expected 1, 2, 4, 6 or 9", cfg.IppNumberUp)
+	}
+	if cfg.IppFidelity {
+		// the printer rejects the whole job when it cannot honor any of its
+		// attributes; without it, unsupported attributes are ignored or
+		// substituted and the job still prints
+		jobAttrs[attributeIppAttributeFidelity] = true
+	}
+	if cfg.IppLanguage != "" {
+		lang := strings.ToLower(cfg.IppLanguage)
+		if !languageTag.MatchString(lang) {
+			return nil, fmt.Errorf("invalid PRINTER_DOCUMENT_LANGUAGE %q, expected a language tag such as th or en-US", cfg.IppLanguage)
+		}
+		jobAttrs[attributeDocumentLanguage] = lang
+	}
+	switch {
+	case cfg.FirstNPages < 0:
+		return nil, fmt.Errorf("invalid PRINTER_FIRST_N_PAGES %d, expected a page count", cfg.FirstNPages)
+	case cfg.FirstNPages > 0:
+		// a preview of each document, e.g. just the cover letter
+		jobAttrs[attributePageRanges] = ippRange{1, cfg.FirstNPages}
+	}
+	if cfg.OperatorMsg != "" {
+		jobAttrs[attributeJobMessageToOperator] = cfg.OperatorMsg
+	}
+
+	var profiles map[string]map[string]any
+	if cfg.ProfilesFile != "" {
+		var err error
+		if profiles, err = loadProfiles(cfg.ProfilesFile); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := profiles[cfg.Profile]; cfg.Profile != "" && !ok {
+		return nil, fmt.Errorf("PRINTER_PROFILE %q is not defined in PRINTER_PROFILES_FILE", cfg.Profile)
+	}
+
+	opAttrs := make(map[string]any)
+	if err := json.Unmarshal([]byte(cfg.IppOpAttrs), &opAttrs); err != nil {
+		log.Printf("Failed to parse operation attributes: %s\n", err)
+	}
+	normalizeAttrs(opAttrs)
+
+	return &jobSettings{
+		defaultJobAttrs: jobAttrs,
+		operationAttrs:  opAttrs,
+		attrFilter:      newAttrFilter(cfg.AllowedAttrs, cfg.DeniedAttrs),
+		maxRemoteQueue:  cfg.MaxRemoteQ,
+		moveRetries:     cfg.MoveRetries,
+		busyRetry:       cfg.BusyRetry,
+		errorBackoff:    cfg.ErrorBackoff,
+		profiles:        profiles,
+		defaultProfile:  cfg.Profile,
+	}, nil
+}
+
+// restartRequired returns the variables that differ between old and cfg but
+// are not applied by a reload.
+func (cfg config) restartRequired(old config) []string {
+	var names []string
+
+	t := reflect.TypeOf(cfg)
+	for n := 0; n < t.NumField(); n++ {
+		name, _, _ := strings.Cut(t.Field(n).Tag.Get("env"), ",")
+		if slices.Contains(reloadableEnv, name) {
+			continue
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(cfg).Field(n).Interface(), reflect.ValueOf(old).Field(n).Interface()) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// configReloader re-reads the configuration and applies the reloadable
+// settings to the running manager. cfg is the configuration the process
+// started with, as loaded: main derives effective values from it, such as
+// the printer found over mDNS, which are not changes to report.
+type configReloader struct {
+	mu  sync.Mutex
+	cfg config
+	ipm *IppPrinterManager
+}
+
+// Reload applies the current configuration. The next job picks up the new
+// settings; a job in flight finishes with the old ones. It returns the
+// changed variables that need a restart.
+func (r *configReloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := cfg.jobSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	r.ipm.settings.Store(settings)
+
+	restart := cfg.restartRequired(r.cfg)
+
+	// the poll workers can be resized, but the poller is only created at
+	// startup
+	if r.ipm.poller != nil && cfg.PollWorkers > 0 {
+		r.ipm.poller.Resize(cfg.PollWorkers)
+		restart = slices.DeleteFunc(restart, func(name string) bool { return name == "PRINTER_POLL_WORKERS" })
+	}
+
+	log.Println("Configuration reloaded")
+	if len(restart) > 0 {
+		log.Printf("Changes to %s require a restart\n", strings.Join(restart, ", "))
+	}
+
+	return restart, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// writeConfigFile makes lines the PRINTER_CONFIG_FILE of the test.
+func writeConfigFile(t *testing.T, file string, lines ...string) {
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PRINTER_CONFIG_FILE", file)
+}
+
+// loadTestConfig returns the configuration of lines.
+func loadTestConfig(t *testing.T, lines ...string) config {
+	writeConfigFile(t, filepath.Join(t.TempDir(), "printer.env"), lines...)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{"unchanged", nil, nil},
+		{"reloadable", []string{"PRINTER_MOVE_RETRIES=5", `PRINTER_JOB_ATTRS={"copies":2}`}, nil},
+		{"restart", []string{"PORT=8080", "PRINTER_NAME=Other"}, []string{"PORT", "PRINTER_NAME"}},
+		{"both", []string{"PORT=8080", "PRINTER_BUSY_RETRY=5s"}, []string{"PORT"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := loadTestConfig(t)
+			cfg := loadTestConfig(t, tt.lines...)
+
+			got := cfg.restartRequired(old)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("restartRequired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "printer.env")
+	writeConfigFile(t, file)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t, newFakePrinter(t))
+	r := &configReloader{cfg: cfg, ipm: m}
+
+	writeConfigFile(t, file, "PORT=8080", "PRINTER_MOVE_RETRIES=7", `PRINTER_JOB_ATTRS={"copies":2}`)
+	restart, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(restart, []string{"PORT"}) {
+		t.Errorf("Reload() = %v, want [PORT]", restart)
+	}
+	settings := m.settings.Load()
+	if settings.moveRetries != 7 || settings.defaultJobAttrs[ipp.AttributeCopies] != 2 {
+		t.Errorf("settings not applied: %+v", settings)
+	}
+
+	writeConfigFile(t, file, "PRINTER_PAGE_PARITY=third")
+	if _, err := r.Reload(); err == nil {
+		t.Error("Reload() accepted an invalid value")
+	}
+	if m.settings.Load() != settings {
+		t.Error("failed reload replaced the settings")
+	}
+}
+
+func TestReloadDuringSweep(t *testing.T) {
+	const files = 20
+	file := filepath.Join(t.TempDir(), "printer.env")
+	writeConfigFile(t, file)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newFakePrinter(t)
+	m := newTestManager(t, p)
+	m.metadataMode = metadataXattr
+	m.stableChecks = 0
+	r := &configReloader{cfg: cfg, ipm: m}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ctx.Err() == nil; n++ {
+			lines := fmt.Sprintf("PRINTER_MOVE_RETRIES=%d\nPRINTER_JOB_ATTRS={\"copies\":%d}\n", n%4, n%3+1)
+			if err := os.WriteFile(file, []byte(lines), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := r.Reload(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// new files are printed, and files submitted before are only moved
+	for n := 0; n < files; n++ {
+		m.sweep(ctx, writeUpload(t, m, fmt.Sprintf("new-%d.pdf", n), testPDF))
+
+		submitted := writeUpload(t, m, fmt.Sprintf("submitted-%d.pdf", n), testPDF)
+		if err := writeSubmitted(submitted, "1", "ipp://localhost/printers/P"); err != nil {
+			t.Fatal(err)
+		}
+		m.sweep(ctx, submitted)
+	}
+	cancel()
+	wg.Wait()
+
+	if names := folderFiles(t, m.printedPath); len(names) != 2*files {
+		t.Errorf("printed %d files, want %d", len(names), 2*files)
+	}
+	if n := len(p.received(ipp.OperationCreateJob)); n != files {
+		t.Errorf("got %d Create-Job requests, want %d", n, files)
+	}
+}
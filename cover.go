@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// qrEncoder renders payload as a PNG image of a QR code. It is set from
+// cover_qr.go, built with the qr tag to keep the QR code dependency
+// optional, and is nil otherwise.
+var qrEncoder func(payload string) ([]byte, error)
+
+// sidecarKeyEntry is the sidecar entry holding the Idempotency-Key an upload
+// was made with. It is not a job attribute and never sent to the printer.
+const sidecarKeyEntry = "idempotency_key"
+
+// takeSidecarKey returns the Idempotency-Key recorded in sidecarAttrs, if
+// any, and removes the entry.
+func takeSidecarKey(sidecarAttrs map[string]any) string {
+	key, _ := sidecarAttrs[sidecarKeyEntry].(string)
+	delete(sidecarAttrs, sidecarKeyEntry)
+
+	return key
+}
+
+// coverPayload expands the PRINTER_QR_URL template for file. {file} is
+// replaced with the escaped file name, {date} with the current date and
+// {id} with what identifies the job. The printer only assigns the job-id once
+// the cover was sent with the job, so {id} is the Idempotency-Key of the
+// upload, key, or the file name for documents uploaded without one.
+func coverPayload(template, file, key string) string {
+	if key == "" {
+		key = filepath.Base(file)
+	}
+
+	return strings.NewReplacer(
+		"{file}", url.PathEscape(filepath.Base(file)),
+		"{date}", time.Now().Format("2006-01-02"),
+		"{id}", url.PathEscape(key),
+	).Replace(template)
+}
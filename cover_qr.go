@@ -0,0 +1,11 @@
+//go:build qr
+
+package main
+
+import "github.com/skip2/go-qrcode"
+
+func init() {
+	qrEncoder = func(payload string) ([]byte, error) {
+		return qrcode.Encode(payload, qrcode.Medium, 1024)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/phin1x/go-ipp"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// encryptedExt matches documents staged encrypted at rest. The suffix is
+// stripped to find the real document type, e.g. "statement.pdf.age".
+var encryptedExt = regexp.MustCompile(`(?i)\.(age|gpg)$`)
+
+// decryptionKeys holds the private key material loaded from
+// PRINTER_DECRYPT_KEY. Either an age identity file or an armored OpenPGP
+// private key ring is accepted.
+type decryptionKeys struct {
+	age []age.Identity
+	pgp openpgp.EntityList
+}
+
+func loadDecryptionKeys(keyPath string) (*decryptionKeys, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if ids, err := age.ParseIdentities(bytes.NewReader(b)); err == nil {
+		return &decryptionKeys{age: ids}, nil
+	}
+
+	if keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b)); err == nil {
+		return &decryptionKeys{pgp: keys}, nil
+	}
+
+	return nil, fmt.Errorf("%s is neither an age identity file nor an armored OpenPGP key ring", keyPath)
+}
+
+// decrypt reads the encrypted file into memory and returns its plaintext.
+// The plaintext is never written to disk; callers should clear it once the
+// document has been submitted.
+func (k *decryptionKeys) decrypt(file string) ([]byte, error) {
+	if k == nil {
+		return nil, errors.New("no decryption key configured (PRINTER_DECRYPT_KEY)")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := encryptedExt.FindStringSubmatch(file)
+	if m == nil {
+		return nil, fmt.Errorf("%s is not an encrypted document", file)
+	}
+
+	var r io.Reader
+	switch ext := strings.ToLower(m[1]); {
+	case ext == "age" && len(k.age) > 0:
+		if r, err = age.Decrypt(f, k.age...); err != nil {
+			return nil, err
+		}
+	case ext == "gpg" && len(k.pgp) > 0:
+		md, err := openpgp.ReadMessage(f, k.pgp, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		r = md.UnverifiedBody
+	default:
+		return nil, fmt.Errorf("no %s key configured to decrypt %s", ext, file)
+	}
+
+	return io.ReadAll(r)
+}
+
+// attributeDocumentPassword is the PWG 5100.13 operation attribute carrying
+// the password the printer uses to open a password-protected PDF.
+const attributeDocumentPassword = "document-password"
+
+// passwordSidecarPath returns the path of the optional file holding the
+// password of a password-protected document.
+func passwordSidecarPath(file string) string {
+	return file + passwordSuffix
+}
+
+const passwordSuffix = ".password"
+
+// loadDocumentPassword reads the password sidecar of file. It returns an
+// empty string when there is none.
+func loadDocumentPassword(file string) (string, error) {
+	b, err := os.ReadFile(passwordSidecarPath(file))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// isPasswordError reports whether the printer rejected a document because
+// its password was missing or wrong.
+func isPasswordError(err error) bool {
+	var ippErr ipp.IPPError
+	return errors.As(err, &ippErr) && ippErr.Status == ipp.StatusErrorDocumentPassword
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/phin1x/go-ipp"
+)
+
+// writeAgeUpload encrypts content to recipient as the upload name.
+func writeAgeUpload(t *testing.T, m *IppPrinterManager, name, content string, recipient age.Recipient) string {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return writeUpload(t, m, name, buf.String())
+}
+
+func TestPrintAgeEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(keyFile, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		recipient age.Recipient
+		wantErr   bool
+	}{
+		{"own key", id.Recipient(), false},
+		{"other key", other.Recipient(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			m := newTestManager(t, p)
+			keys, err := loadDecryptionKeys(keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.decryptKeys = keys
+			file := writeAgeUpload(t, m, "statement.pdf.age", testPDF, tt.recipient)
+
+			if err := m.Print(file); (err != nil) != tt.wantErr {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			sends := p.received(ipp.OperationSendDocument)
+			if tt.wantErr {
+				if len(p.received(ipp.OperationCreateJob)) > 0 {
+					t.Error("undecryptable document was submitted")
+				}
+				if names := folderFiles(t, m.failedPath); len(names) != 1 {
+					t.Errorf("failed folder holds %v", names)
+				}
+				return
+			}
+			if len(sends) == 0 {
+				t.Fatal("no Send-Document")
+			}
+			if doc := sends[0]; string(doc.data) != testPDF || doc.OperationAttributes[ipp.AttributeDocumentName] != "statement.pdf" {
+				t.Errorf("sent %s with %q, want the plaintext of statement.pdf", doc.OperationAttributes[ipp.AttributeDocumentName], doc.data)
+			}
+			for _, dir := range []string{m.uploadPath, m.printedPath} {
+				for _, name := range folderFiles(t, dir) {
+					if b, _ := os.ReadFile(filepath.Join(dir, name)); bytes.Contains(b, []byte(testPDF)) {
+						t.Errorf("plaintext written to %s", filepath.Join(dir, name))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// freeBytes returns the space available to unprivileged users on the
+// filesystem holding path.
+var freeBytes = func(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// lowDisk reports whether free space on the root folder filesystem is below
+// minFreeBytes. It is always false when no minimum is configured.
+func (i IppPrinterManager) lowDisk() (bool, error) {
+	if i.minFreeBytes == 0 {
+		return false, nil
+	}
+
+	free, err := freeBytes(i.rootFolder)
+	if err != nil {
+		return false, fmt.Errorf("failed to read free space of %s: %w", i.rootFolder, err)
+	}
+
+	return free < i.minFreeBytes, nil
+}
+
+// checkDisk logs transitions into and out of the low disk condition and
+// reports whether the watcher should pause.
+func (i IppPrinterManager) checkDisk() bool {
+	low, err := i.lowDisk()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if low != i.diskLow.Swap(low) {
+		if low {
+			log.Printf("Free space on %s is below %d bytes\n", i.rootFolder, i.minFreeBytes)
+		} else {
+			log.Printf("Free space on %s recovered\n", i.rootFolder)
+		}
+	}
+
+	return low && i.pauseOnLowDisk
+}
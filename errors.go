@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"net"
+	"os"
+)
+
+// ErrorCategory tells what part of printing a document failed.
+type ErrorCategory int
+
+const (
+	// CategoryIO is a failure reading or moving local files.
+	CategoryIO ErrorCategory = iota
+	// CategoryConversion is a failure preparing the document for
+	// submission, such as decrypting it.
+	CategoryConversion
+	// CategoryTransport is a failure reaching the printer.
+	CategoryTransport
+	// CategoryPrinterRejected is an IPP error status from the printer.
+	CategoryPrinterRejected
+	// CategoryTimeout is a request to the printer that timed out.
+	CategoryTimeout
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case CategoryIO:
+		return "io"
+	case CategoryConversion:
+		return "conversion"
+	case CategoryTransport:
+		return "transport"
+	case CategoryPrinterRejected:
+		return "rejected"
+	case CategoryTimeout:
+		return "timeout"
+	}
+
+	return fmt.Sprintf("category(%d)", int(c))
+}
+
+// PrintError is returned by Print. It wraps the underlying error with the
+// category of the failure.
+type PrintError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *PrintError) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Category, e.Err)
+}
+
+func (e *PrintError) Unwrap() error {
+	return e.Err
+}
+
+// newPrintError wraps err in a PrintError of category c. A nil err stays
+// nil.
+func newPrintError(c ErrorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &PrintError{Category: c, Err: err}
+}
+
+// submitError wraps an error returned while talking to the printer with the
+// category matching its cause.
+func submitError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ippErr ipp.IPPError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &ippErr):
+		return newPrintError(CategoryPrinterRejected, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return newPrintError(CategoryTimeout, err)
+	}
+
+	return newPrintError(CategoryTransport, err)
+}
+
+// errorCategory returns the category of a PrintError, and reports false for
+// any other error.
+func errorCategory(err error) (ErrorCategory, bool) {
+	var pe *PrintError
+	if !errors.As(err, &pe) {
+		return 0, false
+	}
+
+	return pe.Category, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	eventQueued    = "queued"
+	eventSubmitted = "submitted"
+	eventCompleted = "completed"
+	eventFailed    = "failed"
+)
+
+// jobEvent describes a step in the lifecycle of a printed file.
+type jobEvent struct {
+	Type  string    `json:"type"`
+	File  string    `json:"file"`
+	JobID int       `json:"job_id,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// eventSink delivers job events to an external system.
+type eventSink interface {
+	Publish(e jobEvent) error
+}
+
+// eventSinks holds the sink constructors compiled into the binary, keyed by
+// PRINTER_EVENT_SINK. Implementations register themselves from files built
+// with the matching build tag (nats, redis) to keep their dependencies
+// optional.
+var eventSinks = map[string]func(url, subject string) (eventSink, error){}
+
+func newEventSink(kind, url, subject string) (eventSink, error) {
+	if kind == "" || kind == "none" {
+		return nil, nil
+	}
+
+	newSink, ok := eventSinks[kind]
+	if !ok {
+		return nil, fmt.Errorf("event sink %q is not available in this build", kind)
+	}
+
+	return newSink(url, subject)
+}
+
+// eventPublisher forwards events to a sink from a background goroutine so a
+// slow or unavailable sink never blocks printing. Events are dropped once
+// the buffer is full.
+type eventPublisher struct {
+	sink   eventSink
+	events chan jobEvent
+	done   chan struct{}
+}
+
+func newEventPublisher(sink eventSink, buffer int) *eventPublisher {
+	p := &eventPublisher{
+		sink:   sink,
+		events: make(chan jobEvent, buffer),
+		done:   make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Close publishes the queued events and stops the publisher. Nothing may be
+// published afterwards. It is a no-op on a nil publisher.
+func (p *eventPublisher) Close() {
+	if p == nil {
+		return
+	}
+
+	close(p.events)
+	<-p.done
+}
+
+func (p *eventPublisher) run() {
+	defer close(p.done)
+
+	for e := range p.events {
+		if err := p.sink.Publish(e); err != nil {
+			log.Printf("Failed to publish %s event for %s: %s\n", e.Type, e.File, err)
+		}
+	}
+}
+
+// Publish queues an event. It is a no-op on a nil publisher.
+func (p *eventPublisher) Publish(typ, file string, jobID int, err error) {
+	if p == nil {
+		return
+	}
+
+	e := jobEvent{Type: typ, File: file, JobID: jobID, Time: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	select {
+	case p.events <- e:
+	default:
+		log.Printf("Event buffer full, dropping %s event for %s\n", typ, file)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build nats
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	eventSinks["nats"] = newNatsSink
+}
+
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNatsSink(url, subject string) (eventSink, error) {
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSink{conn: conn, subject: subject}, nil
+}
+
+func (s *natsSink) Publish(e jobEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.conn.Publish(s.subject, b)
+}
@@ -0,0 +1,65 @@
+//go:build nats
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNatsSink(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sub, err := conn.SubscribeSync("print.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := newEventSink("nats", ns.ClientURL(), "print.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newEventPublisher(sink, 8)
+	p.Publish(eventSubmitted, "/srv/upload/a.pdf", 7, nil)
+	p.Publish(eventFailed, "/srv/upload/b.pdf", 0, errors.New("boom"))
+	p.Close()
+
+	want := []jobEvent{
+		{Type: eventSubmitted, File: "/srv/upload/a.pdf", JobID: 7},
+		{Type: eventFailed, File: "/srv/upload/b.pdf", Error: "boom"},
+	}
+	for _, w := range want {
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e jobEvent
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != w.Type || e.File != w.File || e.JobID != w.JobID || e.Error != w.Error || e.Time.IsZero() {
+			t.Errorf("got event %+v, want %+v", e, w)
+		}
+	}
+}
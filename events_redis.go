@@ -0,0 +1,44 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+func init() {
+	eventSinks["redis"] = newRedisSink
+}
+
+// redisSink appends events to a Redis stream.
+type redisSink struct {
+	client *redis.Client
+	stream string
+}
+
+func newRedisSink(url, stream string) (eventSink, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisSink{client: redis.NewClient(opts), stream: stream}, nil
+}
+
+func (s *redisSink) Publish(e jobEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]any{"event": b},
+	}).Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// postHooks are the commands run after each job, configured with
+// PRINTER_POST_SUCCESS_CMD and PRINTER_POST_FAIL_CMD.
+type postHooks struct {
+	success string
+	fail    string
+	timeout time.Duration
+
+	background *lifecycle
+}
+
+// run starts the hook for a finished job in the background. file is where the
+// document ended up: in the printed or failed folder, or its marker in mark
+// mode. The command is executed directly (not through a shell) with the file,
+// job-id and state ("printed" or "failed") as arguments, and the same values
+// plus the error in PRINT_FILE, PRINT_JOB_ID, PRINT_STATE and PRINT_ERROR.
+// Its output is logged once it exits or is killed after the timeout.
+func (h *postHooks) run(file, jobID string, printErr error) {
+	if h == nil {
+		return
+	}
+
+	cmd, state, errText := h.success, "printed", ""
+	if printErr != nil {
+		cmd, state, errText = h.fail, "failed", printErr.Error()
+	}
+	if cmd == "" {
+		return
+	}
+
+	h.background.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+
+		c := exec.CommandContext(ctx, cmd, file, jobID, state)
+		c.Env = append(os.Environ(),
+			"PRINT_FILE="+file,
+			"PRINT_JOB_ID="+jobID,
+			"PRINT_STATE="+state,
+			"PRINT_ERROR="+errText,
+		)
+
+		out, err := c.CombinedOutput()
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			log.Printf("Hook %s for %s: %s\n", cmd, file, out)
+		}
+		if err != nil {
+			log.Printf("Hook %s for %s failed: %s\n", cmd, file, err)
+		}
+	})
+}
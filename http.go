@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idempotencyEntry remembers the outcome of a POST /print carrying an
+// Idempotency-Key header.
+type idempotencyEntry struct {
+	done     bool
+	status   int
+	response any
+	expires  time.Time
+}
+
+type httpServer struct {
+	ipm *IppPrinterManager
+
+	// maxQueueDepth is the number of files waiting in the upload folder
+	// above which new uploads are rejected. Zero disables the limit.
+	maxQueueDepth int
+
+	reloader *configReloader
+	logs     *logRing
+
+	idempotencyTTL time.Duration
+	idemMu         sync.Mutex
+	idempotency    map[string]*idempotencyEntry
+}
+
+func newHTTPServer(ipm *IppPrinterManager, idempotencyTTL time.Duration) *httpServer {
+	return &httpServer{
+		ipm:            ipm,
+		idempotencyTTL: idempotencyTTL,
+		idempotency:    make(map[string]*idempotencyEntry),
+	}
+}
+
+func (s *httpServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/print", s.handlePrint)
+	mux.HandleFunc("/print-latest", s.handlePrintLatest)
+	mux.HandleFunc("/validate", s.handleValidate)
+	mux.HandleFunc("/identify", s.handleIdentify)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/logs", s.handleLogs)
+	mux.HandleFunc("/queue", s.handleQueue)
+
+	return mux
+}
+
+// ListenAndServe serves the HTTP API on addr until ctx is done.
+func (s *httpServer) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	// ListenAndServe returns as soon as Shutdown starts, before the requests
+	// in flight are finished
+	<-shutdown
+
+	return nil
+}
+
+// handlePrint stages the uploaded multipart "file" in the upload folder
+// where the watcher picks it up.
+func (s *httpServer) handlePrint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		entry, ok := s.claimIdempotencyKey(key)
+		if !ok {
+			http.Error(w, "a request with this Idempotency-Key is still being processed", http.StatusConflict)
+			return
+		}
+		if entry != nil {
+			writeJSON(w, entry.status, entry.response)
+			return
+		}
+	}
+
+	if full, err := s.queueFull(); err != nil || full {
+		if key != "" {
+			s.completeIdempotencyKey(key, http.StatusServiceUnavailable, nil)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(queueFullRetryAfter))
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse(errors.New("print queue is full")))
+		return
+	}
+
+	if low, err := s.ipm.lowDisk(); err != nil || low {
+		if key != "" {
+			s.completeIdempotencyKey(key, http.StatusServiceUnavailable, nil)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(queueFullRetryAfter))
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse(errors.New("not enough free disk space")))
+		return
+	}
+
+	status, response := s.stageUpload(r)
+	if key != "" {
+		s.completeIdempotencyKey(key, status, response)
+	}
+
+	writeJSON(w, status, response)
+}
+
+// handlePrintLatest stages the printable file modified last in the ?dir=
+// folder, which must be inside PRINTER_LATEST_ROOTS.
+func (s *httpServer) handlePrintLatest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse(errors.New("missing dir")))
+		return
+	}
+
+	src, staged, err := s.ipm.PrintLatest(dir)
+	switch {
+	case errors.Is(err, errDirNotAllowed):
+		writeJSON(w, http.StatusForbidden, errorResponse(err))
+		return
+	case errors.Is(err, errNoPrintable), errors.Is(err, os.ErrNotExist):
+		writeJSON(w, http.StatusNotFound, errorResponse(err))
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	log.Printf("Staged %s as %s\n", src, staged)
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"source": filepath.Base(src), "file": filepath.Base(staged)})
+}
+
+// handleValidate checks the multipart "file" like handlePrint would print
+// it, without staging it in the upload folder. An optional "attrs" field
+// holds job attributes in the sidecar JSON format.
+func (s *httpServer) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("missing file: %w", err)))
+		return
+	}
+	defer file.Close()
+
+	attrs := make(map[string]any)
+	if v := r.FormValue("attrs"); v != "" {
+		if err := json.Unmarshal([]byte(v), &attrs); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("invalid attrs: %w", err)))
+			return
+		}
+		normalizeAttrs(attrs)
+	}
+	if u := r.Header.Get("X-Print-User"); u != "" {
+		attrs[ipp.AttributeRequestingUserName] = u
+	}
+	if p := r.Header.Get("X-Printer"); p != "" {
+		attrs[sidecarPrinterKey] = p
+	}
+
+	name := filepath.Base(header.Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("invalid file name %q", header.Filename)))
+		return
+	}
+
+	// the document is checked as a file written by this process under its
+	// own name, as a staged upload would be, so that the owner and filename
+	// user sources resolve the same user
+	dir, err := os.MkdirTemp("", "validate-")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	staged := filepath.Join(dir, name)
+	if err := copyToFile(staged, file); err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.ipm.validateDocument(staged, attrs))
+}
+
+// copyToFile writes the content of r to a new file at path.
+func copyToFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// handleIdentify sends Identify-Printer with PRINTER_IDENTIFY_ACTION or the
+// "action" query parameter.
+func (s *httpServer) handleIdentify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	action := r.URL.Query().Get("action")
+	if action == "" {
+		action = s.ipm.identifyAction
+	}
+	if !slices.Contains(identifyActionValues, action) || !s.ipm.isSupported(attributeIdentifyActionsSupported, action) {
+		writeJSON(w, http.StatusBadRequest, errorResponse(fmt.Errorf("identify action %q is not supported", action)))
+		return
+	}
+
+	if err := s.ipm.Identify(action); err != nil {
+		writeJSON(w, http.StatusBadGateway, errorResponse(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "action": action})
+}
+
+// handleStats reports the local and remote queue lengths.
+func (s *httpServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.ipm.pendingCount()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	stats := map[string]any{"pending": pending}
+	if n, err := s.ipm.RemoteQueueLength(); err != nil {
+		stats["printer_error"] = err.Error()
+	} else {
+		stats["printer_queued_jobs"] = n
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleReadyz reports whether the service can accept uploads.
+func (s *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	low, err := s.ipm.lowDisk()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse(err))
+		return
+	}
+	if low {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "low_disk"})
+		return
+	}
+	if stuck := s.ipm.poller.Stuck(); len(stuck) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "printer_stuck", "jobs": stuck})
+		return
+	}
+	if errs := s.ipm.health.Errors(); len(errs) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "printer_error", "printers": errs})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReload re-reads the configuration and lists the changed settings
+// that still need a restart.
+func (s *httpServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	restart, err := s.reloader.Reload()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": true, "restart_required": restart})
+}
+
+// handleLogs returns recent log lines as text, or as JSON with
+// ?format=json. ?n= limits the number of lines and ?level= (info or error)
+// filters them.
+func (s *httpServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		http.Error(w, "log buffer disabled", http.StatusNotFound)
+		return
+	}
+
+	level := r.URL.Query().Get("level")
+	if level != "" && level != logLevelInfo && level != logLevelError {
+		http.Error(w, fmt.Sprintf("invalid level %q, expected info or error", level), http.StatusBadRequest)
+		return
+	}
+
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	lines := s.logs.Lines(n, level)
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, lines)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range lines {
+		fmt.Fprintln(w, l.Text)
+	}
+}
+
+// maxQueuePage is the default and largest number of files returned by
+// GET /queue.
+const maxQueuePage = 500
+
+// handleQueue lists the files in the upload folder. ?offset= and ?limit=
+// page through large queues.
+func (s *httpServer) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := s.ipm.queuedFiles()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, errorResponse(err))
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	offset = min(max(offset, 0), len(files))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > maxQueuePage {
+		limit = maxQueuePage
+	}
+	page := files[offset:min(offset+limit, len(files))]
+	if page == nil {
+		page = []queuedFile{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":  len(files),
+		"offset": offset,
+		"limit":  limit,
+		"files":  page,
+	})
+}
+
+// queueFullRetryAfter is the Retry-After, in seconds, sent with 503 responses
+// when the upload folder is at its maximum depth.
+const queueFullRetryAfter = 30
+
+func (s *httpServer) queueFull() (bool, error) {
+	if s.maxQueueDepth <= 0 {
+		return false, nil
+	}
+
+	n, err := s.ipm.pendingCount()
+	if err != nil {
+		return false, err
+	}
+
+	return n > s.maxQueueDepth, nil
+}
+
+func (s *httpServer) stageUpload(r *http.Request) (int, any) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return http.StatusBadRequest, errorResponse(fmt.Errorf("missing file: %w", err))
+	}
+	defer file.Close()
+
+	name := filepath.Base(header.Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return http.StatusBadRequest, errorResponse(fmt.Errorf("invalid file name %q", header.Filename))
+	}
+
+	// the user, printer and Idempotency-Key of the client travel to the
+	// watcher in the sidecar
+	attrs := make(map[string]any)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		attrs[sidecarKeyEntry] = key
+	}
+	if u := r.Header.Get("X-Print-User"); u != "" {
+		attrs[ipp.AttributeRequestingUserName] = u
+	}
+	if p := r.Header.Get("X-Printer"); p != "" {
+		if _, err := s.ipm.printerFor(p); err != nil {
+			return http.StatusBadRequest, errorResponse(err)
+		}
+		attrs[sidecarPrinterKey] = p
+	}
+
+	staged, err := s.ipm.stage(name, file, attrs)
+	if err != nil {
+		log.Printf("Failed to stage upload %s: %s\n", header.Filename, err)
+		return http.StatusInternalServerError, errorResponse(err)
+	}
+
+	log.Printf("Staged upload %s\n", staged)
+
+	return http.StatusAccepted, map[string]string{"file": filepath.Base(staged)}
+}
+
+// claimIdempotencyKey returns the stored entry for a completed request with
+// the same key, or nil after reserving the key for the current request. It
+// reports false when another request with the key is still in progress.
+func (s *httpServer) claimIdempotencyKey(key string) (*idempotencyEntry, bool) {
+	s.idemMu.Lock()
+	defer s.idemMu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.idempotency {
+		if e.done && now.After(e.expires) {
+			delete(s.idempotency, k)
+		}
+	}
+
+	if e, ok := s.idempotency[key]; ok {
+		if !e.done {
+			return nil, false
+		}
+		return e, true
+	}
+
+	s.idempotency[key] = &idempotencyEntry{}
+	return nil, true
+}
+
+func (s *httpServer) completeIdempotencyKey(key string, status int, response any) {
+	s.idemMu.Lock()
+	defer s.idemMu.Unlock()
+
+	// failed uploads are not remembered so the client can retry them
+	if status != http.StatusAccepted {
+		delete(s.idempotency, key)
+		return
+	}
+
+	s.idempotency[key] = &idempotencyEntry{
+		done:     true,
+		status:   status,
+		response: response,
+		expires:  time.Now().Add(s.idempotencyTTL),
+	}
+}
+
+// stage writes an uploaded document into the upload folder. The document
+// is written to a temporary file first and renamed into place, so the
+// watcher never sees a partial file and concurrent uploads with the same
+// name do not overwrite each other: later ones get a "-N" suffix and keep
+// their original name as job-name. attrs, if any, are written as the
+// sidecar of the staged file before it appears.
+func (i IppPrinterManager) stage(name string, r io.Reader, attrs map[string]any) (string, error) {
+	tmp, err := os.CreateTemp(i.uploadPath, "."+name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	renameMu.Lock()
+	defer renameMu.Unlock()
+
+	dst, err := freeName(filepath.Join(i.uploadPath, name))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if filepath.Base(dst) != name {
+		attrs = maps.Clone(attrs)
+		if attrs == nil {
+			attrs = make(map[string]any)
+		}
+		if _, ok := attrs[ipp.AttributeJobName]; !ok {
+			attrs[ipp.AttributeJobName] = name
+		}
+	}
+	if len(attrs) > 0 {
+		if err := writeSidecarAttrs(dst, attrs); err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		os.Remove(sidecarAttrsPath(dst))
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// writeSidecarAttrs writes job attribute overrides for file.
+func writeSidecarAttrs(file string, attrs map[string]any) error {
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(sidecarAttrsPath(file), b, 0644)
+}
+
+func errorResponse(err error) map[string]string {
+	return map[string]string{"error": err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// uploadRequest returns a POST to target with content as the multipart
+// "file" named name.
+func uploadRequest(t *testing.T, target, name, content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return r
+}
+
+func TestHandlePrint(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     func(t *testing.T) *http.Request
+		status  int
+		sidecar map[string]any
+	}{
+		{
+			name:   "wrong method",
+			req:    func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodGet, "/print", nil) },
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "missing file",
+			req:    func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodPost, "/print", nil) },
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "staged",
+			req:    func(t *testing.T) *http.Request { return uploadRequest(t, "/print", "a.pdf", testPDF) },
+			status: http.StatusAccepted,
+		},
+		{
+			name: "user",
+			req: func(t *testing.T) *http.Request {
+				r := uploadRequest(t, "/print", "a.pdf", testPDF)
+				r.Header.Set("X-Print-User", "alice")
+				return r
+			},
+			status:  http.StatusAccepted,
+			sidecar: map[string]any{"requesting-user-name": "alice"},
+		},
+		{
+			name: "printer",
+			req: func(t *testing.T) *http.Request {
+				r := uploadRequest(t, "/print", "a.pdf", testPDF)
+				r.Header.Set("X-Printer", "P")
+				return r
+			},
+			status:  http.StatusAccepted,
+			sidecar: map[string]any{sidecarPrinterKey: "P"},
+		},
+		{
+			name: "unknown printer",
+			req: func(t *testing.T) *http.Request {
+				r := uploadRequest(t, "/print", "a.pdf", testPDF)
+				r.Header.Set("X-Printer", "Other")
+				return r
+			},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			rec := httptest.NewRecorder()
+			newHTTPServer(m, time.Hour).Handler().ServeHTTP(rec, tt.req(t))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusAccepted {
+				return
+			}
+
+			var resp map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(m.uploadPath, resp["file"])
+			if b, err := os.ReadFile(file); err != nil || string(b) != testPDF {
+				t.Errorf("staged %s holds %q, %v", file, b, err)
+			}
+			sidecar, err := loadSidecarAttrs(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.sidecar {
+				if sidecar[k] != v {
+					t.Errorf("sidecar %s = %v, want %v", k, sidecar[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePrintQueueFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiting int
+		status  int
+	}{
+		{"below the limit", 1, http.StatusAccepted},
+		{"at the limit", 2, http.StatusAccepted},
+		{"above the limit", 3, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			for n := 0; n < tt.waiting; n++ {
+				writeUpload(t, m, fmt.Sprintf("w%d.pdf", n), testPDF)
+			}
+			srv := newHTTPServer(m, time.Hour)
+			srv.maxQueueDepth = 2
+
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, uploadRequest(t, "/print", "a.pdf", testPDF))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+		})
+	}
+}
+
+func TestHandleValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		printable bool
+	}{
+		{"pdf", "a.pdf", testPDF, true},
+		{"truncated pdf", "a.pdf", "%PDF-1.4\n", false},
+		{"unsupported", "a.docx", "PK", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			rec := httptest.NewRecorder()
+			newHTTPServer(m, time.Hour).Handler().ServeHTTP(rec, uploadRequest(t, "/validate", tt.file, tt.content))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var report validationReport
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Printable != tt.printable || tt.printable == (len(report.Issues) > 0) {
+				t.Errorf("report = %+v, want printable %v", report, tt.printable)
+			}
+			if names := folderFiles(t, m.uploadPath); len(names) > 0 {
+				t.Errorf("validation staged %v", names)
+			}
+		})
+	}
+}
+
+func TestHandleValidateOwner(t *testing.T) {
+	owner, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	p := newFakePrinter(t)
+	m := newTestManager(t, p)
+	m.validate = true
+	m.userSource = userSourceOwner
+	rec := httptest.NewRecorder()
+	newHTTPServer(m, time.Hour).Handler().ServeHTTP(rec, uploadRequest(t, "/validate", "a.pdf", testPDF))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	reqs := p.received(ipp.OperationValidateJob)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d Validate-Job requests, want 1", len(reqs))
+	}
+	if got := reqs[0].OperationAttributes[ipp.AttributeRequestingUserName]; got != owner.Username {
+		t.Errorf("Validate-Job requesting-user-name = %v, want %s", got, owner.Username)
+	}
+}
+
+func TestHandlePrintIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []string
+		staged int
+	}{
+		{"same key", []string{"k1", "k1"}, 1},
+		{"different keys", []string{"k1", "k2"}, 2},
+		{"no key", []string{"", ""}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			h := newHTTPServer(m, time.Hour).Handler()
+
+			var files []string
+			for _, key := range tt.keys {
+				r := uploadRequest(t, "/print", "a.pdf", testPDF)
+				if key != "" {
+					r.Header.Set("Idempotency-Key", key)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				if rec.Code != http.StatusAccepted {
+					t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+				}
+				var resp map[string]string
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, resp["file"])
+			}
+
+			var staged []string
+			for _, name := range folderFiles(t, m.uploadPath) {
+				if !sidecars.has(name) {
+					staged = append(staged, name)
+				}
+			}
+			if len(staged) != tt.staged {
+				t.Errorf("staged %v, want %d file(s)", staged, tt.staged)
+			}
+			if same := files[0] == files[1]; same != (tt.staged == 1) {
+				t.Errorf("responses name %v", files)
+			}
+		})
+	}
+}
+
+func TestHandlePrintIdempotencyKeyInProgress(t *testing.T) {
+	s := newHTTPServer(newTestManager(t, newFakePrinter(t)), time.Hour)
+	if _, ok := s.claimIdempotencyKey("k1"); !ok {
+		t.Fatal("key already claimed")
+	}
+
+	r := uploadRequest(t, "/print", "a.pdf", testPDF)
+	r.Header.Set("Idempotency-Key", "k1")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestHandlePrintConcurrentSameName(t *testing.T) {
+	const uploads = 4
+	m := newTestManager(t, newFakePrinter(t))
+	h := newHTTPServer(m, time.Hour).Handler()
+
+	var wg sync.WaitGroup
+	files := make([]string, uploads)
+	for n := range files {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, uploadRequest(t, "/print", "report.pdf", fmt.Sprintf("%s%% upload %d\n", testPDF, n)))
+			var resp map[string]string
+			if rec.Code != http.StatusAccepted || json.NewDecoder(rec.Body).Decode(&resp) != nil {
+				t.Errorf("upload %d: status = %d: %s", n, rec.Code, rec.Body)
+				return
+			}
+			files[n] = resp["file"]
+		}(n)
+	}
+	wg.Wait()
+
+	contents := make(map[string]bool)
+	for _, name := range files {
+		file := filepath.Join(m.uploadPath, name)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[string(b)] = true
+
+		if name == "report.pdf" {
+			continue
+		}
+		sidecar, err := loadSidecarAttrs(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sidecar[ipp.AttributeJobName]; got != "report.pdf" {
+			t.Errorf("%s job-name = %v, want report.pdf", name, got)
+		}
+	}
+	if len(contents) != uploads {
+		t.Errorf("staged %v hold %d distinct uploads, want %d", files, len(contents), uploads)
+	}
+}
+
+func TestHandleLogs(t *testing.T) {
+	logs := newLogRing(10)
+	logs.Write([]byte("2026/10/14 06:00:00 Printed /srv/upload/a.pdf\n2026/10/14 06:00:01 Failed to print /srv/upload/b.pdf: boom\n"))
+
+	tests := []struct {
+		query  string
+		status int
+		lines  int
+	}{
+		{"?format=json", http.StatusOK, 2},
+		{"?format=json&level=error", http.StatusOK, 1},
+		{"?format=json&n=1", http.StatusOK, 1},
+		{"?level=debug", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		s := newHTTPServer(newTestManager(t, newFakePrinter(t)), time.Hour)
+		s.logs = logs
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs"+tt.query, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var lines []logLine
+		if err := json.NewDecoder(rec.Body).Decode(&lines); err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != tt.lines {
+			t.Errorf("%s: got %d lines, want %d", tt.query, len(lines), tt.lines)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"slices"
+	"strings"
+)
+
+// identify-actions (PWG 5100.13) is the operation attribute of
+// Identify-Printer telling the printer how to make itself noticed.
+const (
+	attributeIdentifyActions          = "identify-actions"
+	attributeIdentifyActionsSupported = "identify-actions-supported"
+)
+
+// identifyActionValues are the identify-actions keywords accepted in
+// PRINTER_IDENTIFY_ACTION.
+var identifyActionValues = []string{"display", "flash", "sound", "speak"}
+
+func init() {
+	ipp.AttributeTagMapping[attributeIdentifyActions] = ipp.TagKeyword
+}
+
+// Identify sends Identify-Printer so that the printer flashes, beeps or
+// otherwise shows which device it is. It fails without contacting the
+// printer when action is not listed in identify-actions-supported.
+func (i IppPrinterManager) Identify(action string) error {
+	if !slices.Contains(identifyActionValues, action) {
+		return fmt.Errorf("invalid identify action %q, expected one of %s", action, strings.Join(identifyActionValues, ", "))
+	}
+	if !i.isSupported(attributeIdentifyActionsSupported, action) {
+		return fmt.Errorf("identify action %q is not supported by the printer", action)
+	}
+
+	req := ipp.NewRequest(ipp.OperationIdentifyPrinter, 1)
+	req.OperationAttributes[ipp.AttributePrinterURI] = fmt.Sprintf("ipp://localhost/printers/%s", i.printerName)
+	req.OperationAttributes[attributeIdentifyActions] = action
+
+	_, err := i.client.SendRequest(i.adapter.GetHttpUri("printers", i.printerName), req, nil)
+	return err
+}
+
+// identifyCommand implements the identify command, which runs Identify
+// with PRINTER_IDENTIFY_ACTION or the --action flag.
+func identifyCommand(ipm *IppPrinterManager, args []string) error {
+	fs := flag.NewFlagSet("identify", flag.ExitOnError)
+	action := fs.String("action", ipm.identifyAction, "identify action: "+strings.Join(identifyActionValues, ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := ipm.Identify(*action); err != nil {
+		return err
+	}
+	fmt.Printf("Sent Identify-Printer (%s) to %s\n", *action, ipm.primaryPrinter())
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+const (
+	dupJobIDSuffix = "suffix"
+	dupJobIDIgnore = "ignore"
+
+	// jobIDMemory is how long a job-id returned by the printer is remembered
+	// to detect duplicates.
+	jobIDMemory = 24 * time.Hour
+)
+
+// printerJobID is a job-id of the printer at uri. Pool and failover printers
+// number their jobs independently, so a job-id is only unique per printer.
+type printerJobID struct {
+	uri string
+	id  int
+}
+
+// seenJobID is a job-id a printer returned before.
+type seenJobID struct {
+	count int
+	last  time.Time
+}
+
+// recordJobID remembers jId of the printer at uri and returns how many
+// earlier submissions to that printer got the same job-id. Printers that
+// always report 0 are not tracked. The caller must hold i.mu.
+func (i IppPrinterManager) recordJobID(uri string, jId int) int {
+	if jId <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	for key, s := range i.jobIDs {
+		if now.Sub(s.last) > jobIDMemory {
+			delete(i.jobIDs, key)
+		}
+	}
+
+	key := printerJobID{uri: uri, id: jId}
+	s, ok := i.jobIDs[key]
+	if !ok {
+		s = &seenJobID{}
+		i.jobIDs[key] = s
+	}
+	s.count++
+	s.last = now
+
+	return s.count - 1
+}
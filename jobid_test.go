@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/phin1x/go-ipp"
+)
+
+func TestRecordJobID(t *testing.T) {
+	type submission struct {
+		uri string
+		id  int
+	}
+	tests := []struct {
+		name        string
+		submissions []submission
+		want        []int
+	}{
+		{"distinct", []submission{{"a", 1}, {"a", 2}, {"a", 3}}, []int{0, 0, 0}},
+		{"repeated", []submission{{"a", 5}, {"a", 5}, {"a", 5}}, []int{0, 1, 2}},
+		{"per printer", []submission{{"a", 5}, {"b", 5}, {"a", 5}}, []int{0, 0, 1}},
+		{"not reported", []submission{{"a", 0}, {"a", 0}}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			for n, s := range tt.submissions {
+				if got := m.recordJobID(s.uri, s.id); got != tt.want[n] {
+					t.Errorf("submission %d: recordJobID(%s, %d) = %d, want %d", n, s.uri, s.id, got, tt.want[n])
+				}
+			}
+		})
+	}
+}
+
+func TestPrintRepeatedJobID(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{dupJobIDSuffix, "_7-2_b.pdf"},
+		{dupJobIDIgnore, "_7_b.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			p := newFakePrinter(t)
+			p.handle = func(req fakeRequest) *ipp.Response {
+				resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+				resp.JobAttributes = []ipp.Attributes{jobIDAttrs(7)}
+				return resp
+			}
+			m := newTestManager(t, p)
+			m.dupJobIDPolicy = tt.policy
+
+			for _, name := range []string{"a.pdf", "b.pdf"} {
+				if err := m.Print(writeUpload(t, m, name, testPDF)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			found := false
+			for _, name := range folderFiles(t, m.printedPath) {
+				found = found || strings.HasSuffix(name, tt.want)
+			}
+			if !found {
+				t.Errorf("printed folder holds %v, want a file ending in %s", folderFiles(t, m.printedPath), tt.want)
+			}
+		})
+	}
+}
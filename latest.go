@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errDirNotAllowed = errors.New("directory is not inside PRINTER_LATEST_ROOTS")
+	errNoPrintable   = errors.New("no printable file found")
+)
+
+// latestFile returns the printable file directly in dir that was modified
+// last. Sidecars, markers and subfolders are ignored; files modified at the
+// same time are told apart by name.
+func latestFile(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var latest string
+	var latestInfo os.FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !isPrintable(name) || sidecars.has(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+
+		if latestInfo == nil || info.ModTime().After(latestInfo.ModTime()) ||
+			info.ModTime().Equal(latestInfo.ModTime()) && name > latest {
+			latest, latestInfo = name, info
+		}
+	}
+	if latestInfo == nil {
+		return "", fmt.Errorf("%w in %s", errNoPrintable, dir)
+	}
+
+	return filepath.Join(dir, latest), nil
+}
+
+// allowedDir resolves dir and fails with errDirNotAllowed unless it is one
+// of latestRoots or inside one. The check is made before and after symlinks
+// are resolved, so that they cannot lead out of a root and paths outside
+// the roots are refused whether they exist or not.
+func (i IppPrinterManager) allowedDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if !i.inLatestRoots(abs) {
+		return "", fmt.Errorf("%w: %s", errDirNotAllowed, dir)
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	if !i.inLatestRoots(resolved) {
+		return "", fmt.Errorf("%w: %s", errDirNotAllowed, dir)
+	}
+
+	return resolved, nil
+}
+
+// inLatestRoots reports whether the absolute path dir is one of latestRoots
+// or inside one, comparing it with the roots as given and resolved.
+func (i IppPrinterManager) inLatestRoots(dir string) bool {
+	for _, root := range i.latestRoots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		roots := []string{abs}
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			roots = append(roots, resolved)
+		}
+
+		for _, root := range roots {
+			rel, err := filepath.Rel(root, dir)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// PrintLatest stages a copy of the printable file in dir modified last into
+// the upload folder, where the watcher prints it like an upload, e.g. for a
+// "print the latest scan" button. The original is left in place. It returns
+// the selected file and the staged copy.
+func (i IppPrinterManager) PrintLatest(dir string) (string, string, error) {
+	dir, err := i.allowedDir(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	src, err := latestFile(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	staged, err := i.stage(filepath.Base(src), f, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	return src, staged, nil
+}
+
+// printLatestCommand implements the print-latest command, which runs
+// PrintLatest on the directory given as its argument.
+func printLatestCommand(ipm *IppPrinterManager, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: print-latest <dir>")
+	}
+
+	src, staged, err := ipm.PrintLatest(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Staged %s as %s\n", src, staged)
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatestFile(t *testing.T) {
+	base := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name  string
+		files map[string]time.Duration
+		want  string
+		err   error
+	}{
+		{
+			name:  "newest",
+			files: map[string]time.Duration{"a.pdf": 1 * time.Minute, "b.pdf": 3 * time.Minute, "c.pdf": 2 * time.Minute},
+			want:  "b.pdf",
+		},
+		{
+			name:  "skips other files",
+			files: map[string]time.Duration{"a.pdf": 1 * time.Minute, "b.docx": 3 * time.Minute, "a.pdf.attrs.json": 4 * time.Minute},
+			want:  "a.pdf",
+		},
+		{
+			name:  "same time",
+			files: map[string]time.Duration{"a.pdf": time.Minute, "b.pdf": time.Minute},
+			want:  "b.pdf",
+		},
+		{
+			name:  "none",
+			files: map[string]time.Duration{"b.docx": time.Minute},
+			err:   errNoPrintable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, age := range tt.files {
+				file := filepath.Join(dir, name)
+				if err := os.WriteFile(file, []byte(testPDF), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(file, base.Add(age), base.Add(age)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Mkdir(filepath.Join(dir, "z.pdf"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := latestFile(dir)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("latestFile() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && got != filepath.Join(dir, tt.want) {
+				t.Errorf("latestFile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedDir(t *testing.T) {
+	root := t.TempDir()
+	scans := filepath.Join(root, "scans")
+	outside := t.TempDir()
+	if err := os.Mkdir(scans, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir     string
+		allowed bool
+	}{
+		{root, true},
+		{scans, true},
+		{filepath.Join(scans, ".."), true},
+		{outside, false},
+		{filepath.Join(root, "link"), false},
+		{filepath.Join(root, "..", filepath.Base(outside)), false},
+	}
+	m := IppPrinterManager{latestRoots: []string{root}}
+	for _, tt := range tests {
+		_, err := m.allowedDir(tt.dir)
+		if (err == nil) != tt.allowed {
+			t.Errorf("allowedDir(%s) error = %v, want allowed %v", tt.dir, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "sync"
+
+// lifecycle tracks the background goroutines of the manager, so that
+// WatchFiles only returns once every one of them has exited. Goroutines
+// started through it must stop on their own, e.g. when their context is
+// done.
+type lifecycle struct {
+	wg sync.WaitGroup
+}
+
+// Go runs fn in a tracked goroutine. On a nil lifecycle the goroutine is
+// started untracked.
+func (l *lifecycle) Go(fn func()) {
+	if l == nil {
+		go fn()
+		return
+	}
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until every tracked goroutine has exited. It is a no-op on a
+// nil lifecycle.
+func (l *lifecycle) Wait() {
+	if l == nil {
+		return
+	}
+
+	l.wg.Wait()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// discardSink drops every event.
+type discardSink struct{}
+
+func (discardSink) Publish(jobEvent) error { return nil }
+
+func TestWatchFilesStopsGoroutines(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+
+	p := newFakePrinter(t)
+	m := newTestManager(t, p)
+	m.metadataMode = metadataXattr
+	m.stableChecks = 0
+	m.events = newEventPublisher(discardSink{}, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.poller = newJobPoller(m.client, m.adapter, 2, 10*time.Millisecond)
+	m.poller.Start(ctx, m.background)
+	m.background.Go(func() { m.RefreshCapabilities(ctx, time.Hour) })
+	writeUpload(t, m, "a.pdf", testPDF)
+
+	done := make(chan error, 1)
+	go func() { done <- m.WatchFiles(ctx) }()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(m.printedPath, "a.pdf")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a.pdf was not printed")
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections to the printer are not goroutines of the manager
+	m.adapter.client.CloseIdleConnections()
+	p.srv.Close()
+	goleak.VerifyNone(t, ignore)
+}
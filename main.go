@@ -1,193 +1,1708 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/caarlos0/env/v11"
 	"github.com/phin1x/go-ipp"
+	"io"
 	"log"
 	"maps"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type config struct {
-	Port         int    `env:"PORT" envDefault:"3000"`
-	IppHost      string `env:"PRINTER_HOST" envDefault:"localhost"`
-	IppPort      int    `env:"PRINTER_PORT" envDefault:"631"`
-	IppUser      string `env:"PRINTER_USER" envDefault:""`
-	IppPass      string `env:"PRINTER_PASS" envDefault:""`
-	IppTls       bool   `env:"PRINTER_TLS" envDefault:"false"`
-	IppPrinter   string `env:"PRINTER_NAME" envDefault:"Printer"`
-	IppJobAttrs  string `env:"PRINTER_JOB_ATTRS" envDefault:"{}"`
-	FileRootPath string `env:"FILE_ROOT_PATH" envDefault:"./files"`
+	Port         int           `env:"PORT" envDefault:"3000"`
+	IppHost      string        `env:"PRINTER_HOST" envDefault:"localhost"`
+	IppPort      int           `env:"PRINTER_PORT" envDefault:"631"`
+	IppUser      string        `env:"PRINTER_USER" envDefault:""`
+	IppPass      string        `env:"PRINTER_PASS" envDefault:""`
+	TlsCert      string        `env:"PRINTER_TLS_CLIENT_CERT" envDefault:""`
+	TlsKey       string        `env:"PRINTER_TLS_CLIENT_KEY" envDefault:""`
+	MaxConns     int           `env:"PRINTER_MAX_CONNS" envDefault:"0"`
+	ProxyURL     string        `env:"PRINTER_PROXY_URL" envDefault:""`
+	IppVersion   string        `env:"PRINTER_IPP_VERSION" envDefault:"2.0"`
+	IppDowngrade bool          `env:"PRINTER_IPP_AUTO_DOWNGRADE" envDefault:"false"`
+	IppSocket    string        `env:"PRINTER_SOCKET" envDefault:""`
+	IppTls       bool          `env:"PRINTER_TLS" envDefault:"false"`
+	IppPrinter   string        `env:"PRINTER_NAME" envDefault:"Printer"`
+	IppJobAttrs  string        `env:"PRINTER_JOB_ATTRS" envDefault:"{}"`
+	IppOpAttrs   string        `env:"PRINTER_OPERATION_ATTRS" envDefault:"{}"`
+	DocFormat    string        `env:"PRINTER_DOCUMENT_FORMAT" envDefault:"auto"`
+	UserSource   string        `env:"PRINTER_USER_SOURCE" envDefault:"process"`
+	IppMediaCol  string        `env:"PRINTER_MEDIA_COL" envDefault:""`
+	IppMediaSrc  string        `env:"PRINTER_MEDIA_SOURCE" envDefault:""`
+	IppReverse   bool          `env:"PRINTER_REVERSE_PAGES" envDefault:"false"`
+	IppScaling   string        `env:"PRINTER_PRINT_SCALING" envDefault:""`
+	IppOptimize  string        `env:"PRINTER_CONTENT_OPTIMIZE" envDefault:""`
+	IppParity    string        `env:"PRINTER_PAGE_PARITY" envDefault:"all"`
+	IppOutputBin string        `env:"PRINTER_OUTPUT_BIN" envDefault:""`
+	IppAccountID string        `env:"PRINTER_JOB_ACCOUNT_ID" envDefault:""`
+	IppAcctUser  string        `env:"PRINTER_JOB_ACCOUNTING_USER_ID" envDefault:""`
+	IppNumberUp  int           `env:"PRINTER_NUMBER_UP" envDefault:"0"`
+	IppFidelity  bool          `env:"PRINTER_ATTRIBUTE_FIDELITY" envDefault:"false"`
+	IppLanguage  string        `env:"PRINTER_DOCUMENT_LANGUAGE" envDefault:""`
+	FirstNPages  int           `env:"PRINTER_FIRST_N_PAGES" envDefault:"0"`
+	OperatorMsg  string        `env:"PRINTER_OPERATOR_MESSAGE" envDefault:""`
+	ProfilesFile string        `env:"PRINTER_PROFILES_FILE" envDefault:""`
+	Profile      string        `env:"PRINTER_PROFILE" envDefault:""`
+	DrainTimeout time.Duration `env:"PRINTER_DRAIN_TIMEOUT" envDefault:"0"`
+	IdemTTL      time.Duration `env:"PRINTER_IDEMPOTENCY_TTL" envDefault:"10m"`
+	MaxRemoteQ   int           `env:"PRINTER_MAX_REMOTE_QUEUE" envDefault:"0"`
+	BusyRetry    time.Duration `env:"PRINTER_BUSY_RETRY" envDefault:"0"`
+	ErrorBackoff time.Duration `env:"PRINTER_ERROR_BACKOFF" envDefault:"0"`
+	MaxQueue     int           `env:"PRINTER_MAX_QUEUE_DEPTH" envDefault:"0"`
+	PostOkCmd    string        `env:"PRINTER_POST_SUCCESS_CMD" envDefault:""`
+	PostFailCmd  string        `env:"PRINTER_POST_FAIL_CMD" envDefault:""`
+	HookTimeout  time.Duration `env:"PRINTER_HOOK_TIMEOUT" envDefault:"30s"`
+	StartupAct   string        `env:"PRINTER_STARTUP_ACTION" envDefault:"process"`
+	Unsupported  string        `env:"PRINTER_UNSUPPORTED_ACTION" envDefault:"skip"`
+	Completion   string        `env:"PRINTER_COMPLETION_MODE" envDefault:"move"`
+	MoveOn       string        `env:"PRINTER_MOVE_ON" envDefault:"submit"`
+	EventSink    string        `env:"PRINTER_EVENT_SINK" envDefault:"none"`
+	EventURL     string        `env:"PRINTER_EVENT_URL" envDefault:""`
+	EventSubject string        `env:"PRINTER_EVENT_SUBJECT" envDefault:"print.jobs"`
+	AllowedAttrs []string      `env:"PRINTER_ALLOWED_ATTRS" envSeparator:","`
+	DeniedAttrs  []string      `env:"PRINTER_DENIED_ATTRS" envSeparator:","`
+	LatestRoots  []string      `env:"PRINTER_LATEST_ROOTS" envSeparator:","`
+	MoveRetries  int           `env:"PRINTER_MOVE_RETRIES" envDefault:"3"`
+	RetryJitter  bool          `env:"PRINTER_RETRY_JITTER" envDefault:"true"`
+	Source       string        `env:"PRINTER_SOURCE" envDefault:""`
+	DecryptKey   string        `env:"PRINTER_DECRYPT_KEY" envDefault:""`
+	CapsRefresh  time.Duration `env:"PRINTER_CAPS_REFRESH" envDefault:"5m"`
+	PollWorkers  int           `env:"PRINTER_POLL_WORKERS" envDefault:"0"`
+	PollInterval time.Duration `env:"PRINTER_POLL_INTERVAL" envDefault:"5s"`
+	PollRetries  int           `env:"PRINTER_POLL_RETRIES" envDefault:"5"`
+	ProcTimeout  time.Duration `env:"PRINTER_PROCESSING_TIMEOUT" envDefault:"0"`
+	CancelStuck  bool          `env:"PRINTER_CANCEL_STUCK" envDefault:"false"`
+	MinFree      uint64        `env:"PRINTER_MIN_FREE_BYTES" envDefault:"0"`
+	MaxUploadAge time.Duration `env:"PRINTER_MAX_UPLOAD_AGE" envDefault:"0"`
+	SortOrder    string        `env:"PRINTER_SORT_ORDER" envDefault:"name"`
+	ChecksumAlgo string        `env:"PRINTER_CHECKSUM_ALGO" envDefault:""`
+	ReadXMP      bool          `env:"PRINTER_READ_XMP" envDefault:"false"`
+	MetadataMode string        `env:"PRINTER_METADATA_MODE" envDefault:"filename"`
+	WarnAsError  bool          `env:"PRINTER_WARN_AS_ERROR" envDefault:"false"`
+	QrCover      bool          `env:"PRINTER_QR_COVER" envDefault:"false"`
+	Compression  string        `env:"PRINTER_COMPRESSION" envDefault:"none"`
+	QrURL        string        `env:"PRINTER_QR_URL" envDefault:"{file}"`
+	LowDiskPause bool          `env:"PRINTER_LOW_DISK_PAUSE" envDefault:"false"`
+	Receipts     bool          `env:"PRINTER_RECEIPTS" envDefault:"false"`
+	ReceiptFmt   string        `env:"PRINTER_RECEIPT_FORMAT" envDefault:"pdf"`
+	JobSequence  bool          `env:"PRINTER_JOB_SEQUENCE" envDefault:"false"`
+	FailoverHost string        `env:"PRINTER_FAILOVER_HOST" envDefault:""`
+	FailoverName string        `env:"PRINTER_FAILOVER_NAME" envDefault:"Printer"`
+	FailRetries  int           `env:"PRINTER_FAILOVER_RETRIES" envDefault:"2"`
+	Pool         string        `env:"PRINTER_POOL" envDefault:""`
+	PoolMode     string        `env:"PRINTER_POOL_MODE" envDefault:"round-robin"`
+	StableChecks int           `env:"PRINTER_STABLE_CHECKS" envDefault:"1"`
+	StableIntvl  time.Duration `env:"PRINTER_STABLE_INTERVAL" envDefault:"3s"`
+	DupJobID     string        `env:"PRINTER_DUP_JOBID_POLICY" envDefault:"suffix"`
+	ValidateJob  bool          `env:"PRINTER_VALIDATE_JOB" envDefault:"false"`
+	IdentifyAct  string        `env:"PRINTER_IDENTIFY_ACTION" envDefault:"flash"`
+	LogBuffer    int           `env:"PRINTER_LOG_BUFFER" envDefault:"500"`
+	FollowRedir  bool          `env:"PRINTER_FOLLOW_REDIRECT" envDefault:"false"`
+	MdnsName     string        `env:"PRINTER_MDNS_NAME" envDefault:""`
+	MdnsTimeout  time.Duration `env:"PRINTER_MDNS_TIMEOUT" envDefault:"3s"`
+	MdnsRetry    bool          `env:"PRINTER_MDNS_RERESOLVE" envDefault:"false"`
+	FileRootPath string        `env:"FILE_ROOT_PATH" envDefault:"./files"`
 }
 
 type IppPrinterManager struct {
 	mu          *sync.Mutex
 	client      *ipp.IPPClient
+	adapter     *httpAdapter
 	printerName string
 	rootFolder  string
 	uploadPath  string
 	printedPath string
 	failedPath  string
 
-	defaultJobAttrs map[string]any
+	receipts     bool
+	receiptsPath string
+	receiptFmt   string
+	checksumAlgo string
+	readXMP      bool
+	warnAsError  bool
+	qrCover      string
+	compression  string
+	metadataMode string
+
+	unsupportedAction string
+	unsupportedPath   string
+
+	// settings are replaced as a whole by a reload; an operation loads
+	// them once so that it never mixes old and new values
+	settings *atomic.Pointer[jobSettings]
+	caps     *capabilityCache
+	health   *printerHealth
+
+	drainTimeout   time.Duration
+	completionMode string
+	events         *eventPublisher
+	poller         *jobPoller
+	remote         *remoteSource
+	pool           *printerPool
+	failover       *poolMember
+	hooks          *postHooks
+	spool          storage
+
+	userSource  string
+	formatMode  string
+	useSeq      bool
+	validate    bool
+	decryptKeys *decryptionKeys
+
+	identifyAction string
+	latestRoots    []string
+
+	jobIDs         map[printerJobID]*seenJobID
+	dupJobIDPolicy string
+
+	background *lifecycle
+
+	stuck       *sync.Map
+	awaiting    *sync.Map
+	moveOn      string
+	retryJitter bool
+
+	// failoverRetries is how many more times an unavailable primary is
+	// tried before a job goes to the failover printer
+	failoverRetries int
+
+	stableChecks   int
+	stableInterval time.Duration
+	maxUploadAge   time.Duration
+	sortOrder      string
+
+	minFreeBytes   uint64
+	pauseOnLowDisk bool
+	diskLow        *atomic.Bool
+}
+
+// printableExt matches the file extensions that are sent to the printer.
+var printableExt = regexp.MustCompile(`(?i)\.(pdf|png|jpg|jpeg|pwg|pcl)(\.age|\.gpg)?$`)
+
+// isPrintable reports whether file is sent to the printer: it has one of the
+// printableExt extensions or names its document-format with a format token.
+func isPrintable(file string) bool {
+	if printableExt.MatchString(file) {
+		return true
+	}
+
+	if sidecars.has(file) {
+		return false
+	}
+
+	_, _, ok := parseFormatToken(encryptedExt.ReplaceAllString(path.Base(file), ""))
+	return ok
 }
 
 //go:embed img.png
 var img []byte
 
+// jobAttrs builds the job attributes of file, printed as fileName, from the
+// defaults, the selected profile, the document's XMP print intent and its
+// sidecar, in increasing precedence. It also returns the attributes left
+// out because they are filtered or not supported by the printer. The
+// profile and first-n-pages entries are removed from sidecarAttrs.
+func (i IppPrinterManager) jobAttrs(file, fileName string, xmpAttrs, sidecarAttrs map[string]any) (map[string]any, []string, error) {
+	settings := i.settings.Load()
+	ja := make(map[string]any)
+	maps.Copy(ja, settings.defaultJobAttrs)
+
+	profile, err := settings.profileAttrs(fileName, sidecarAttrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the document's own print intent overrides the defaults and the
+	// profile, and a sidecar overrides both
+	maps.Copy(ja, profile)
+	maps.Copy(ja, xmpAttrs)
+	if err := applyFirstPages(ja, sidecarAttrs); err != nil {
+		return nil, nil, err
+	}
+	maps.Copy(ja, sidecarAttrs)
+	ignored := settings.attrFilter.apply(ja)
+	truncateOperatorMessage(ja)
+
+	if _, ok := ja[ipp.AttributeRequestingUserName]; !ok {
+		if u := i.requestingUser(file); u != "" {
+			ja[ipp.AttributeRequestingUserName] = u
+		}
+	}
+	if _, ok := ja[ipp.AttributeJobName]; !ok {
+		jobName := fileName
+		if i.userSource == userSourceFilename {
+			_, jobName = splitFilenameUser(fileName)
+		}
+		if _, stripped, ok := parseFormatToken(jobName); ok {
+			jobName = stripped
+		}
+		jobName = profileToken.ReplaceAllString(jobName, "")
+		ja[ipp.AttributeJobName] = jobName
+	}
+	for k, v := range settings.operationAttrs {
+		ja[k] = operationAttr{v}
+	}
+
+	if _, ok := ja[attributePrintContentOptimize]; !ok {
+		if v := contentOptimizeFor(detectedType(fileName)); v != "" {
+			ja[attributePrintContentOptimize] = v
+		}
+	}
+	i.applyMediaSource(ja)
+	for _, c := range [][2]string{
+		{ipp.AttributeNumberUp, attributeNumberUpSupported},
+		{attributePrintScaling, attributePrintScalingSupported},
+		{attributePrintContentOptimize, attributePrintContentOptimizeSupported},
+		{attributeOutputBin, attributeOutputBinSupported},
+	} {
+		if i.dropUnsupported(ja, c[0], c[1]) {
+			ignored = append(ignored, c[0])
+		}
+	}
+	for _, c := range [][2]string{
+		{attributeJobAccountID, attributeJobAccountIDSupported},
+		{attributeJobAccountingUserID, attributeJobAccountingUserIDSupported},
+	} {
+		if i.requireSupported(ja, c[0], c[1]) {
+			ignored = append(ignored, c[0])
+		}
+	}
+
+	return ja, ignored, nil
+}
+
+// Print submits file and moves it to the printed or failed folder. Files the
+// printer is not ready for are left for the next sweep. It holds i.mu for
+// the whole job, so that jobs are submitted one at a time and jobDone does
+// not move files in between. Conversion and printer errors mark the file
+// as failed; I/O errors leave it to be retried.
 func (i IppPrinterManager) Print(file string) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	// if file extension not in list, skip (pdf, png, jpg, jpeg, pwg, pcl)
-	if !regexp.MustCompile(`(?i)\.(pdf|png|jpg|jpeg|pwg|pcl)$`).MatchString(file) {
-		fmt.Println("file extension not in list, skipping")
+	// if file extension not in list, skip (pdf, png, jpg, jpeg, pwg, pcl, optionally .age/.gpg encrypted)
+	if !isPrintable(file) {
+		i.handleUnsupported(file)
 		return nil
 	}
 
-	fileStats, err := os.Stat(file)
+	sidecarAttrs, err := loadSidecarAttrs(file)
+	if err != nil {
+		return newPrintError(CategoryIO, err)
+	}
+	target, targetErr := i.sidecarPrinter(sidecarAttrs)
+
+	// the printer is chosen before anything else so that a busy or stopped
+	// printer holds the job back, and Validate-Job asks the printer that
+	// gets it
+	var member *poolMember
+	var pickErr error
+	if targetErr == nil {
+		var ready bool
+		if member, ready, pickErr = i.readyPrinter(file, target); !ready {
+			return nil
+		}
+	}
+
+	if max := i.settings.Load().maxRemoteQueue; max > 0 {
+		if n, err := i.RemoteQueueLength(); err != nil {
+			log.Printf("Failed to read printer queue length: %s\n", err)
+		} else if n > max {
+			log.Printf("Printer has %d queued jobs, deferring %s\n", n, file)
+			return nil
+		}
+	}
+
+	i.events.Publish(eventQueued, file, 0, nil)
+
+	if targetErr != nil {
+		err := newPrintError(CategoryConversion, targetErr)
+		i.markFailed(file, err)
+		return err
+	}
+
+	job, err := i.prepareJob(file, sidecarAttrs)
 	if err != nil {
+		// documents that cannot be converted fail for good, I/O errors are
+		// retried by the next sweep
+		if c, _ := errorCategory(err); c == CategoryConversion {
+			i.markFailed(file, err)
+		}
 		return err
 	}
+	defer job.close()
+
+	if i.validate && pickErr == nil {
+		if err := submitError(i.validateJob(member, job.ja, job.docAttrs, i.documentFormat(job.fileName))); err != nil {
+			if isCapabilityError(err) {
+				i.caps.invalidate()
+			}
+			i.writeReceipt(file, 0, "", job.ja, job.sum, nil, err)
+			i.markFailed(file, err)
+			i.events.Publish(eventFailed, file, 0, err)
+			return err
+		}
+	}
 
-	fileName := path.Base(file)
-	document, err := os.Open(file)
+	// warnings of the validation are not about the job
+	i.adapter.takeWarnings()
+
+	jId, printerURI, failedOver, err := i.submitJob(job, member, pickErr)
+	if c, ok := errorCategory(err); ok && c == CategoryIO {
+		// the document could not be read again for a retry
+		return err
+	}
+	var ignored []string
+	if err == nil && i.pool == nil && !failedOver {
+		warnings := i.adapter.takeWarnings()
+		if ignored = ignoredAttrs(warnings); len(ignored) > 0 {
+			log.Printf("Printer ignored or substituted %s for %s\n", strings.Join(ignored, ", "), file)
+		}
+		if len(warnings) > 0 && i.warnAsError {
+			// the job was accepted and may print; the file is kept in the
+			// failed folder for review
+			err = newPrintError(CategoryPrinterRejected, warnings[0])
+		}
+	}
+	rec := newReceipt(file, jId, printerURI, job.ja, job.sum, ignored, err)
 	if err != nil {
+		i.saveReceipt(rec)
+		if isCapabilityError(err) {
+			i.caps.invalidate()
+		}
+		i.markFailed(file, err)
+		i.events.Publish(eventFailed, file, 0, err)
 		return err
 	}
-	defer document.Close()
 
-	ja := map[string]any{
-		ipp.AttributeJobName: fileName,
+	log.Printf("Printed %s\n", file)
+
+	return i.submitted(job, jId, printerURI, failedOver, rec)
+}
+
+// printJob is a document prepared by prepareJob for submission.
+type printJob struct {
+	file     string
+	fileName string
+	// document is positioned at docStart, the first byte sent to the
+	// printer, and holds size bytes from there
+	document io.ReadSeeker
+	docStart int64
+	size     int
+
+	ja       map[string]any
+	docAttrs map[string]any
+	user     string
+	password string
+	sum      string
+
+	// compressed, when set, is sent instead of document, and cover, when
+	// set, before it
+	compressed []byte
+	cover      []byte
+
+	close func()
+}
+
+// prepareJob reads file, decrypting it and skipping anything before the
+// PDF header, and derives its job attributes from the settings,
+// sidecarAttrs and the document's metadata. Errors are PrintErrors:
+// CategoryConversion for documents that cannot be printed, CategoryIO for
+// documents that could not be read. The caller closes the job.
+func (i IppPrinterManager) prepareJob(file string, sidecarAttrs map[string]any) (*printJob, error) {
+	fileStats, err := os.Stat(file)
+	if err != nil {
+		return nil, newPrintError(CategoryIO, err)
+	}
+
+	j := &printJob{file: file, fileName: path.Base(file), size: int(fileStats.Size()), close: func() {}}
+	if encryptedExt.MatchString(file) {
+		plain, err := i.decryptKeys.decrypt(file)
+		if err != nil {
+			return nil, newPrintError(CategoryConversion, err)
+		}
+
+		j.document = bytes.NewReader(plain)
+		j.size = len(plain)
+		j.fileName = encryptedExt.ReplaceAllString(j.fileName, "")
+		j.close = func() { clear(plain) }
+	} else {
+		f, err := i.openSpool(file)
+		if err != nil {
+			return nil, newPrintError(CategoryIO, err)
+		}
+
+		j.document = f
+		j.close = func() { f.Close() }
+	}
+
+	if err := i.readJob(j, sidecarAttrs); err != nil {
+		j.close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// readJob fills in j from its opened document and sidecarAttrs.
+func (i IppPrinterManager) readJob(j *printJob, sidecarAttrs map[string]any) error {
+	var err error
+	if isPDF(j.fileName) {
+		skipped, err := skipToPDFHeader(j.document)
+		if err != nil {
+			return newPrintError(CategoryIO, err)
+		}
+		if skipped > 0 {
+			log.Printf("Skipping %d bytes before the PDF header of %s\n", skipped, j.file)
+			j.size -= int(skipped)
+		}
+
+		complete, err := hasPDFTrailer(j.document)
+		if err != nil {
+			return newPrintError(CategoryIO, err)
+		}
+		if !complete {
+			return newPrintError(CategoryConversion, fmt.Errorf("%s is truncated: no %%%%EOF marker", j.fileName))
+		}
+	}
+
+	var xmpAttrs map[string]any
+	if i.readXMP && isPDF(j.fileName) {
+		if xmpAttrs, err = readXMPAttrs(j.document); err != nil {
+			log.Printf("Failed to read XMP metadata of %s: %s\n", j.fileName, err)
+		}
+	}
+
+	idemKey := takeSidecarKey(sidecarAttrs)
+	if j.ja, _, err = i.jobAttrs(j.file, j.fileName, xmpAttrs, sidecarAttrs); err != nil {
+		return newPrintError(CategoryConversion, err)
+	}
+
+	j.docAttrs = documentAttrs(j.ja)
+	j.user = jobUser(j.ja)
+	if j.password, err = loadDocumentPassword(j.file); err != nil {
+		return newPrintError(CategoryIO, err)
+	}
+	if j.password != "" {
+		j.docAttrs[attributeDocumentPassword] = j.password
+	}
+
+	if j.docStart, err = j.document.Seek(0, io.SeekCurrent); err != nil {
+		return newPrintError(CategoryIO, err)
+	}
+	if i.checksumAlgo != "" {
+		// the bytes sent to the printer, i.e. the plaintext of encrypted
+		// documents without anything before the PDF header
+		if j.sum, err = checksum(i.checksumAlgo, j.document); err != nil {
+			return newPrintError(CategoryIO, err)
+		}
+		log.Printf("Checksum of %s: %s\n", j.file, j.sum)
+	}
+	compression := i.compressionFor()
+	if compression != compressionNone {
+		if j.compressed, err = compress(compression, j.document); err != nil {
+			return newPrintError(CategoryIO, err)
+		}
+		log.Printf("Compressed %s from %d to %d bytes with %s\n", j.file, j.size, len(j.compressed), compression)
+		j.docAttrs[attributeCompression] = compression
+	}
+	if i.qrCover != "" {
+		if j.cover, err = qrEncoder(coverPayload(i.qrCover, j.file, idemKey)); err != nil {
+			return newPrintError(CategoryConversion, err)
+		}
+	}
+
+	return nil
+}
+
+// documents returns the documents of a submission of j, reading its
+// document from the start again.
+func (i IppPrinterManager) documents(j *printJob) ([]ipp.Document, error) {
+	if _, err := j.document.Seek(j.docStart, io.SeekStart); err != nil {
+		return nil, newPrintError(CategoryIO, err)
 	}
-	maps.Copy(ja, i.defaultJobAttrs)
 
 	docs := []ipp.Document{
 		{
-			Document: document,
-			Name:     fileName,
-			Size:     int(fileStats.Size()),
-			MimeType: ipp.MimeTypeOctetStream,
+			Document: j.document,
+			Name:     j.fileName,
+			Size:     j.size,
+			MimeType: i.documentFormat(j.fileName),
 		},
 		{
 			Document: strings.NewReader(string(img)),
 			Name:     "img.png",
 			Size:     len(img),
-			MimeType: ipp.MimeTypeOctetStream,
+			MimeType: i.documentFormat("img.png"),
 		},
 	}
+	if j.compressed != nil {
+		docs[0].Document = bytes.NewReader(j.compressed)
+		docs[0].Size = len(j.compressed)
+	}
+	docs[0].Document = withDocumentAttrs(docs[0].Document, j.docAttrs)
+	if j.cover != nil {
+		docs = slices.Insert(docs, 0, ipp.Document{
+			Document: bytes.NewReader(j.cover),
+			Name:     "cover.png",
+			Size:     len(j.cover),
+			MimeType: i.documentFormat("cover.png"),
+		})
+	}
+	if j.user != "" {
+		// go-ipp sends Send-Document as the client's user, which
+		// printers restricting jobs to their owner reject
+		for n := range docs {
+			docs[n].Document = withDocumentAttrs(docs[n].Document, map[string]any{ipp.AttributeRequestingUserName: j.user})
+		}
+	}
+
+	return docs, nil
+}
+
+// submitJob submits j to member, the pool member or failover printer
+// chosen for it, or to the configured printer when member is nil. pickErr
+// is the error of choosing a pool member. An unavailable primary printer
+// is retried failoverRetries times before the job goes to the failover
+// printer. It returns the job-id, the URI of the printer that took the job
+// and whether that is the failover printer. Submission errors are
+// categorized by submitError; a CategoryIO error means the document could
+// not be read again for a retry.
+func (i IppPrinterManager) submitJob(j *printJob, member *poolMember, pickErr error) (int, string, bool, error) {
+	// a document can be submitted again when the printer was unreachable,
+	// but not when it may hold an incomplete job with it
+	unavailable := func(err error) bool {
+		c, _ := errorCategory(err)
+		return (c == CategoryTransport || c == CategoryTimeout) && !errors.Is(err, errJobMayPrint)
+	}
 
-	jId, err := i.client.PrintDocuments(docs, i.printerName, ja)
+	docs, err := i.documents(j)
 	if err != nil {
-		os.Rename(file, strings.Replace(file, "/upload/", fmt.Sprintf("/failed/%s_", time.Now().Format("2006-01-02")), 1))
-		return err
+		return -1, "", false, err
 	}
 
-	fmt.Printf("Printed %s\n", file)
+	var jId int
+	failedOver := false
+	printerURI := i.adapter.GetHttpUri("printers", i.printerName)
+	switch {
+	case i.pool != nil:
+		err = pickErr
+		if err == nil {
+			printerURI = member.uri()
+			jId, err = i.printPool(member, docs, j.ja, j.user)
+		}
+		err = submitError(err)
+	case member != nil:
+		// only the failover printer was ready
+		jId, err = submit(member.client, member.adapter, docs, member.printer, j.ja, j.user)
+		if err = submitError(err); err == nil {
+			log.Printf("Job %d for %s handled by failover printer %s/%s\n", jId, j.file, member.addr, member.printer)
+			failedOver = true
+			printerURI = member.uri()
+		}
+	default:
+		jId, err = submit(i.client, i.adapter, docs, i.printerName, j.ja, j.user)
+		err = submitError(err)
+		for attempt := 0; i.failover != nil && attempt < i.failoverRetries && unavailable(err); attempt++ {
+			d := backoff(time.Second, attempt, i.retryJitter)
+			log.Printf("Primary printer unavailable for %s, retrying in %s (%d/%d): %s\n", j.file, d, attempt+1, i.failoverRetries, err)
+			time.Sleep(d)
+			if docs, err = i.documents(j); err != nil {
+				return -1, "", false, err
+			}
+			jId, err = submit(i.client, i.adapter, docs, i.printerName, j.ja, j.user)
+			err = submitError(err)
+		}
+	}
 
-	newFile := strings.Replace(file, "/upload/", fmt.Sprintf("/printed/%s_%d_", time.Now().Format("2006-01-02"), jId), 1)
-	if err := os.Rename(file, newFile); err != nil {
-		return err
+	if i.failover != nil && member != i.failover && unavailable(err) {
+		log.Printf("Primary printer unavailable for %s, failing over to %s/%s: %s\n", j.file, i.failover.addr, i.failover.printer, err)
+		if docs, err = i.documents(j); err != nil {
+			return -1, "", false, err
+		}
+		jId, err = submit(i.failover.client, i.failover.adapter, docs, i.failover.printer, j.ja, j.user)
+		if err = submitError(err); err == nil {
+			log.Printf("Job %d for %s handled by failover printer %s/%s\n", jId, j.file, i.failover.addr, i.failover.printer)
+			failedOver = true
+			printerURI = i.failover.uri()
+		}
 	}
 
-	fmt.Printf("Moved to %s\n", newFile)
+	return jId, printerURI, failedOver, err
+}
+
+// submitted does the bookkeeping of j after printerURI accepted it as job
+// jId: it records the job, announces it and moves the file, or with
+// PRINTER_MOVE_ON=complete leaves that to jobDone once the job is done.
+// rec is the receipt of the submission.
+func (i IppPrinterManager) submitted(j *printJob, jId int, printerURI string, failedOver bool, rec receipt) error {
+	file := j.file
+	if j.password != "" {
+		// the job has the password now; until it was accepted the sidecar
+		// stayed with the document so that a retry can still use it
+		if err := os.Remove(passwordSidecarPath(file)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete the password sidecar of %s: %s\n", file, err)
+		}
+	}
+
+	id := strconv.Itoa(jId)
+	dup := i.recordJobID(printerURI, jId)
+	if dup > 0 {
+		log.Printf("Printer returned job-id %d again for %s (%s)\n", jId, file, i.dupJobIDPolicy)
+		if i.dupJobIDPolicy == dupJobIDSuffix {
+			id = fmt.Sprintf("%d-%d", jId, dup+1)
+		}
+	}
+	notify := dup == 0 || i.dupJobIDPolicy != dupJobIDIgnore
+
+	if notify {
+		i.events.Publish(eventSubmitted, file, jId, nil)
+	}
+
+	if i.useSeq {
+		// the printer's job-id is not trusted to be unique, e.g. it is 0
+		seq, err := i.nextSeq()
+		if err != nil {
+			i.saveReceipt(rec)
+			return newPrintError(CategoryIO, err)
+		}
+		id = strconv.Itoa(seq)
+	}
+
+	// until the file is moved, the marker keeps a sweep, also after a
+	// restart, from submitting it again
+	if err := writeSubmitted(file, id, printerURI); err != nil {
+		log.Printf("Failed to mark %s as submitted: %s\n", file, err)
+	}
+
+	if i.pool == nil && !failedOver && dup == 0 {
+		// pool and failover job-ids belong to other printers and are not
+		// polled, and a repeated job-id would replace the first job's state
+		var onDone func(pollState)
+		if i.moveOn == moveOnComplete {
+			i.awaiting.Store(file, struct{}{})
+			onDone = func(s pollState) { i.jobDone(file, id, printerURI, s, rec) }
+		}
+		if i.poller.Track(jId, file, j.user, onDone) && onDone != nil {
+			log.Printf("Waiting for job %d to complete before moving %s\n", jId, file)
+			return nil
+		}
+		i.awaiting.Delete(file)
+	}
+
+	i.saveReceipt(rec)
+	return i.completed(file, id, printerURI, jId, notify)
+}
+
+// completed records file as printed by printer and announces it.
+func (i IppPrinterManager) completed(file, id, printer string, jobID int, notify bool) error {
+	printed, err := i.markPrinted(file, id, printer)
+	if err != nil {
+		return newPrintError(CategoryIO, err)
+	}
+	i.hooks.run(printed, id, nil)
+	if notify {
+		i.events.Publish(eventCompleted, file, jobID, nil)
+	}
 
 	return nil
 }
 
+// jobDone is called by the poller when the job of file, submitted with
+// PRINTER_MOVE_ON=complete, reached the terminal state s. Only completed
+// jobs count as printed; aborted and canceled ones are moved to failed. A
+// job whose polling failed was accepted by the printer and counts as
+// printed, as with PRINTER_MOVE_ON=submit. The receipt r of the submission
+// is written with the final state. It runs on a poll worker and holds i.mu
+// like Print, as moving the file reads the job settings.
+func (i IppPrinterManager) jobDone(file, id, printer string, s pollState, r receipt) {
+	defer i.awaiting.Delete(file)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if s.Untracked {
+		i.saveReceipt(r)
+		log.Printf("Moving %s without knowing whether job %d completed\n", file, s.JobID)
+		if err := i.completed(file, id, printer, s.JobID, true); err != nil {
+			log.Printf("Failed to mark %s as printed: %s\n", file, err)
+		}
+		return
+	}
+
+	if s.State != int(ipp.JobStateCompleted) {
+		err := newPrintError(CategoryPrinterRejected, fmt.Errorf("job %d ended in state %d %v", s.JobID, s.State, s.Reasons))
+		r.State, r.Error = "failed", err.Error()
+		i.saveReceipt(r)
+		i.markFailed(file, err)
+		i.events.Publish(eventFailed, file, s.JobID, err)
+		return
+	}
+
+	i.saveReceipt(r)
+	if err := i.completed(file, id, printer, s.JobID, true); err != nil {
+		log.Printf("Failed to mark %s as printed: %s\n", file, err)
+	}
+}
+
+const (
+	moveOnSubmit   = "submit"
+	moveOnComplete = "complete"
+)
+
+const (
+	completionMove = "move"
+	completionMark = "mark"
+
+	markerPrinted = ".printed"
+	markerFailed  = ".failed"
+
+	// markerSubmitted holds the job id of a file that was submitted but
+	// is not marked as printed or failed yet, and the printer that took it.
+	markerSubmitted = ".submitted"
+)
+
+// writeSubmitted writes the submitted marker of file.
+func writeSubmitted(file, id, printer string) error {
+	return os.WriteFile(file+markerSubmitted, []byte(id+"\n"+printer+"\n"), 0644)
+}
+
+// removeSubmitted deletes the submitted marker of file, if any.
+func removeSubmitted(file string) {
+	if err := os.Remove(file + markerSubmitted); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove the submitted marker of %s: %s\n", file, err)
+	}
+}
+
+// submittedJob returns the job id and printer in the submitted marker of
+// file. Markers of earlier versions hold no printer.
+func submittedJob(file string) (string, string, bool) {
+	b, err := os.ReadFile(file + markerSubmitted)
+	if err != nil {
+		return "", "", false
+	}
+
+	id, printer, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+
+	return id, printer, true
+}
+
+// markPrinted records that file was printed as job id (the job-id, or the
+// local sequence number when enabled), either by moving it to the printed
+// folder or, in mark mode, by writing a ".printed" marker next to it. It
+// returns the path of the moved file or of the marker. printer is the
+// printer that took the job.
+func (i IppPrinterManager) markPrinted(file, id, printer string) (string, error) {
+	if i.completionMode == completionMark {
+		if err := os.WriteFile(file+markerPrinted, []byte(id+"\n"), 0644); err != nil {
+			return "", err
+		}
+		log.Printf("Marked %s as printed\n", file)
+		removeSubmitted(file)
+		i.remote.Complete(file, true)
+		return file + markerPrinted, nil
+	}
+
+	prefix := ""
+	if i.namesCarryMetadata() {
+		prefix = fmt.Sprintf("%s_%s_", time.Now().Format("2006-01-02"), id)
+	}
+	newFile, err := i.moveFile(file, strings.Replace(file, "/upload/", "/printed/"+prefix, 1))
+	if err != nil {
+		// the job was submitted, so later sweeps, also after a restart,
+		// only retry the move instead of printing the file again
+		if werr := writeSubmitted(file, id, printer); werr != nil {
+			log.Printf("Failed to mark %s as submitted, it will not be processed again until restart: %s\n", file, werr)
+			return "", err
+		}
+		i.stuck.Delete(file)
+		log.Printf("%s was submitted as job %s, moving it is retried on the next sweep\n", file, id)
+		return "", err
+	}
+	sidecars.move(file, newFile)
+	i.writeMetadata(newFile, id, printer, "printed", nil)
+	removeSubmitted(file)
+	i.remote.Complete(file, true)
+
+	log.Printf("Moved to %s\n", newFile)
+
+	return newFile, nil
+}
+
+// errExpired is the failure of a file that stayed in the upload folder for
+// longer than PRINTER_MAX_UPLOAD_AGE.
+var errExpired = errors.New("expired before it could be printed")
+
+// markFailed records that printing file failed with printErr, either by
+// moving it to the failed folder or, in mark mode, by writing a ".failed"
+// marker next to it. The fail hook gets the moved file or the marker, or
+// file itself when neither could be written.
+func (i IppPrinterManager) markFailed(file string, printErr error) {
+	i.remote.Complete(file, false)
+
+	if i.completionMode == completionMark {
+		if err := os.WriteFile(file+markerFailed, []byte(printErr.Error()+"\n"), 0644); err != nil {
+			log.Printf("Failed to mark %s as failed: %s\n", file, err)
+			i.hooks.run(file, "0", printErr)
+			return
+		}
+		removeSubmitted(file)
+		i.hooks.run(file+markerFailed, "0", printErr)
+		return
+	}
+
+	prefix := ""
+	if i.namesCarryMetadata() {
+		prefix = time.Now().Format("2006-01-02")
+		if isPasswordError(printErr) {
+			prefix += "_wrongpassword"
+		} else if errors.Is(printErr, errExpired) {
+			prefix += "_expired"
+		} else if c, ok := errorCategory(printErr); ok {
+			prefix += "_" + c.String()
+		}
+		prefix += "_"
+	}
+
+	failedFile, err := i.moveFile(file, strings.Replace(file, "/upload/", "/failed/"+prefix, 1))
+	if err != nil {
+		log.Printf("%s will not be processed again until restart\n", file)
+		i.hooks.run(file, "0", printErr)
+		return
+	}
+	sidecars.move(file, failedFile)
+	i.writeMetadata(failedFile, "", "", "failed", printErr)
+	removeSubmitted(file)
+	i.hooks.run(failedFile, "0", printErr)
+}
+
+const (
+	unsupportedSkip   = "skip"
+	unsupportedMove   = "move"
+	unsupportedDelete = "delete"
+)
+
+// handleUnsupported applies the unsupported action to a file that is not
+// printable. Sidecars, markers and temporary files are always left alone.
+func (i IppPrinterManager) handleUnsupported(file string) {
+	if sidecars.has(file) {
+		return
+	}
+
+	switch i.unsupportedAction {
+	case unsupportedMove:
+		newFile, err := i.moveSpool(file, filepath.Join(i.unsupportedPath, filepath.Base(file)))
+		if err != nil {
+			log.Printf("Failed to move unsupported file %s: %s\n", file, err)
+			return
+		}
+		sidecars.move(file, newFile)
+		log.Printf("Moved unsupported file %s to %s\n", file, newFile)
+	case unsupportedDelete:
+		if err := i.removeSpool(file); err != nil {
+			log.Printf("Failed to delete unsupported file %s: %s\n", file, err)
+			return
+		}
+		sidecars.remove(file)
+		log.Printf("Deleted unsupported file %s\n", file)
+	default:
+		// remembered so that the sweeps of this run do not log it again
+		i.stuck.Store(file, struct{}{})
+		log.Printf("Skipping %s, its extension is not printable\n", file)
+	}
+}
+
+// isCompleted reports whether file already carries a completion marker.
+func isCompleted(file string) bool {
+	for _, m := range []string{markerPrinted, markerFailed} {
+		if _, err := os.Stat(file + m); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// moveFile moves file out of the upload folder through i.spool, retrying
+// transient failures (common right after a write on CIFS/NFS mounts) with a
+// doubling backoff. When every attempt fails the file is remembered as stuck
+// so later sweeps do not print it again.
+func (i IppPrinterManager) moveFile(file, dst string) (string, error) {
+	retries := i.settings.Load().moveRetries
+	for attempt := 0; ; attempt++ {
+		newFile, err := i.moveSpool(file, dst)
+		if err == nil {
+			return newFile, nil
+		}
+
+		if attempt >= retries || !isTransientFSError(err) {
+			log.Printf("ERROR: failed to move %s to %s after %d attempt(s): %s\n", file, dst, attempt+1, err)
+			i.stuck.Store(file, struct{}{})
+			return "", err
+		}
+
+		time.Sleep(backoff(200*time.Millisecond, attempt, i.retryJitter))
+	}
+}
+
+// backoff returns the delay before retry attempt (counting from 0) of a
+// delay starting at base and doubling with every attempt. With jitter the
+// delay is drawn at random up to that value, so that callers failing at the
+// same time do not retry in lockstep.
+func backoff(base time.Duration, attempt int, jitter bool) time.Duration {
+	d := base << attempt
+	if jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d)))
+	}
+
+	return d
+}
+
+func isTransientFSError(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETXTBSY) || errors.Is(err, syscall.EAGAIN)
+}
+
+// isStuck reports whether file is not processed again in this run, because
+// it could not be moved after printing or it was skipped at startup.
+func (i IppPrinterManager) isStuck(file string) bool {
+	_, ok := i.stuck.Load(file)
+	return ok
+}
+
+// isAwaiting reports whether file was submitted and waits for its job to
+// complete before it is moved.
+func (i IppPrinterManager) isAwaiting(file string) bool {
+	_, ok := i.awaiting.Load(file)
+	return ok
+}
+
+var renameMu sync.Mutex
+
+// safeRename moves src to dst without overwriting an existing file. When dst
+// is taken, an incrementing "-1", "-2", ... suffix is inserted before the
+// extension. It returns the path the file was actually moved to.
+func safeRename(src, dst string) (string, error) {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+
+	target, err := freeName(dst)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(src, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// freeName returns dst, or dst with the first "-N" suffix that does not
+// exist yet. The caller must hold renameMu until the name is used.
+func freeName(dst string) (string, error) {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+
+	target := dst
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target, nil
+		} else if err != nil {
+			return "", err
+		}
+		target = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+const (
+	startupProcess      = "process"
+	startupSkip         = "skip"
+	startupMoveToFailed = "move-to-failed"
+)
+
+// handleLeftovers applies the startup action to the printable files already
+// in the upload folder before the watcher starts. skip leaves them in place
+// but never prints them in this run; move-to-failed moves them to the
+// failed folder for review.
+func (i IppPrinterManager) handleLeftovers(action string) error {
+	if action == startupProcess {
+		return nil
+	}
+
+	return filepath.Walk(i.uploadPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !isPrintable(path) || isCompleted(path) {
+			return nil
+		}
+		if _, _, ok := submittedJob(path); ok {
+			// printed already, the sweep finishes moving it
+			return nil
+		}
+
+		if action == startupSkip {
+			log.Printf("Skipping %s left over from a previous run\n", path)
+			i.stuck.Store(path, struct{}{})
+			return nil
+		}
+
+		log.Printf("Moving %s left over from a previous run to failed\n", path)
+		i.markFailed(path, errors.New("left over from a previous run"))
+		return nil
+	})
+}
+
 func (i IppPrinterManager) WatchFiles(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			err := i.drain()
+			i.background.Wait()
+			// the goroutines above may publish until they exit
+			i.events.Close()
+			return err
 		default:
-			if err := i.PrintAll(); err != nil {
+			i.recreateFolders()
+			if i.checkDisk() {
+				sleepCtx(ctx, 5*time.Second)
+				continue
+			}
+			if i.remote != nil && !i.diskLow.Load() {
+				if err := i.remote.Sync(ctx, i); err != nil {
+					log.Printf("Failed to sync remote source: %s\n", err)
+				}
+			}
+			if err := i.PrintAll(ctx); err != nil {
 				log.Println(err)
 			}
-			time.Sleep(1 * time.Second)
+			sleepCtx(ctx, 1*time.Second)
 		}
 
 	}
 }
 
-func (i IppPrinterManager) PrintAll() error {
-	return filepath.Walk(i.uploadPath, func(path string, info os.FileInfo, err error) error {
+// drain keeps printing the upload folder after shutdown was requested until
+// it is empty or drainTimeout expires. With a zero timeout only the file that
+// was in flight is finished and the rest is left for the next start. Jobs
+// still awaiting completion are no longer polled; their files keep the
+// submitted marker and the next start moves them to the printed folder.
+func (i IppPrinterManager) drain() error {
+	if i.drainTimeout <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.drainTimeout)
+	defer cancel()
+
+	for {
+		remaining, err := i.pendingCount()
 		if err != nil {
 			return err
 		}
-
-		if info.IsDir() {
+		if remaining == 0 {
+			log.Println("Upload folder drained")
+			return nil
+		}
+		if ctx.Err() != nil {
+			log.Printf("Drain timeout reached, %d file(s) left in upload folder\n", remaining)
 			return nil
 		}
 
-		time.Sleep(3 * time.Second)
-		if err := i.Print(path); err != nil {
-			log.Printf("Failed to print %s: %s\n", path, err)
+		log.Printf("Draining upload folder, %d file(s) remaining\n", remaining)
+		if err := i.PrintAll(ctx); err != nil {
+			log.Println(err)
 		}
+		sleepCtx(ctx, 1*time.Second)
+	}
+}
 
+// pendingCount returns the number of printable files in the upload folder
+// that are not awaiting the completion of their job.
+func (i IppPrinterManager) pendingCount() (int, error) {
+	n := 0
+	err := filepath.Walk(i.uploadPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && isPrintable(path) && !isCompleted(path) && !i.isStuck(path) && !i.isAwaiting(path) {
+			n++
+		}
 		return nil
+	})
+
+	return n, err
+}
+
+// Sort orders of a PrintAll sweep (PRINTER_SORT_ORDER).
+const (
+	sortName      = "name"
+	sortMtimeAsc  = "mtime-asc"
+	sortMtimeDesc = "mtime-desc"
+)
+
+// sortFiles orders the files of a sweep by sortOrder. Files with the same
+// modification time keep their lexical order.
+func sortFiles(files []string, infos map[string]os.FileInfo, sortOrder string) {
+	switch sortOrder {
+	case sortMtimeAsc:
+		slices.SortStableFunc(files, func(a, b string) int { return infos[a].ModTime().Compare(infos[b].ModTime()) })
+	case sortMtimeDesc:
+		slices.SortStableFunc(files, func(a, b string) int { return infos[b].ModTime().Compare(infos[a].ModTime()) })
+	}
+}
 
+func (i IppPrinterManager) PrintAll(ctx context.Context) error {
+	var files []string
+	infos := make(map[string]os.FileInfo)
+	err := filepath.Walk(i.uploadPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			infos[path] = info
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	sortFiles(files, infos, i.sortOrder)
+	for _, path := range files {
+		if ctx.Err() != nil {
+			return nil
+		}
+		i.sweep(ctx, path)
+	}
+
+	return nil
+}
+
+// sweep handles one file found by PrintAll.
+func (i IppPrinterManager) sweep(ctx context.Context, path string) {
+	// earlier files of the sweep may have taken it along, e.g. a sidecar
+	info, err := os.Lstat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to stat %s: %s\n", path, err)
+		}
+		return
+	}
+
+	if sidecars.has(path) || isCompleted(path) || i.isStuck(path) || i.isAwaiting(path) {
+		return
+	}
+
+	if id, printer, ok := submittedJob(path); ok {
+		printed, err := i.markPrinted(path, id, printer)
+		if err != nil {
+			log.Printf("Failed to move printed file %s: %s\n", path, err)
+			return
+		}
+		i.hooks.run(printed, id, nil)
+		return
+	}
+
+	// devices, sockets, FIFOs and symlinks are never read as documents
+	if !info.Mode().IsRegular() {
+		log.Printf("Skipping non-regular file %s (%s)\n", path, info.Mode().Type())
+		return
+	}
+
+	// a printer that was down for days should not work through a backlog
+	// nobody wants anymore once it comes back
+	if i.maxUploadAge > 0 && isPrintable(path) && time.Since(info.ModTime()) > i.maxUploadAge {
+		log.Printf("%s is older than %s, moving it to failed\n", path, i.maxUploadAge)
+		i.markFailed(path, errExpired)
+		return
+	}
+
+	stable, err := i.waitStable(ctx, path, info)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to stat %s: %s\n", path, err)
+		return
+	}
+	if !stable {
+		log.Printf("%s is still being written, retrying later\n", path)
+		return
+	}
+	if err := i.Print(path); err != nil {
+		log.Printf("Failed to print %s: %s\n", path, err)
+	}
+}
+
+// waitStable reports whether file keeps the size and modification time of
+// info across stableChecks consecutive checks stableInterval apart. Files
+// still being copied are picked up again on a later sweep.
+func (i IppPrinterManager) waitStable(ctx context.Context, file string, info os.FileInfo) (bool, error) {
+	for n := 0; n < i.stableChecks; n++ {
+		if !sleepCtx(ctx, i.stableInterval) {
+			return false, ctx.Err()
+		}
+
+		cur, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if cur.Size() != info.Size() || !cur.ModTime().Equal(info.ModTime()) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// sleepCtx sleeps for d or until ctx is done, reporting whether the full
+// duration elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// LoadCapabilities fetches the printer attributes used to validate job
+// attributes before submission.
+func (i IppPrinterManager) LoadCapabilities() error {
+	caps, err := i.client.GetPrinterAttributes(i.printerName, capabilityAttrs)
+	if err != nil {
+		return err
+	}
+
+	i.caps.set(caps)
+	return nil
+}
+
+// RemoteQueueLength returns the number of jobs queued on the printer itself.
+func (i IppPrinterManager) RemoteQueueLength() (int, error) {
+	attrs, err := i.client.GetPrinterAttributes(i.printerName, []string{attributeQueuedJobCount})
+	if err != nil {
+		return 0, err
+	}
+
+	return queuedJobCount(attrs)
+}
+
+func queuedJobCount(attrs ipp.Attributes) (int, error) {
+	v := attrs[attributeQueuedJobCount]
+	if len(v) == 0 {
+		return 0, errors.New("printer did not report queued-job-count")
+	}
+
+	n, ok := v[0].Value.(int)
+	if !ok {
+		return 0, fmt.Errorf("unexpected queued-job-count value %v", v[0].Value)
+	}
+
+	return n, nil
 }
 
 func NewIppPrinterManager(client *ipp.IPPClient, printerName, rootFolder string, jobAttr map[string]any) (*IppPrinterManager, error) {
 	ipm := &IppPrinterManager{
-		client:          client,
-		printerName:     printerName,
-		defaultJobAttrs: jobAttr,
+		client:      client,
+		printerName: printerName,
+		settings:    &atomic.Pointer[jobSettings]{},
+
+		mu:         &sync.Mutex{},
+		background: &lifecycle{},
+		stuck:      &sync.Map{},
+		awaiting:   &sync.Map{},
+		jobIDs:     make(map[printerJobID]*seenJobID),
+		caps:       newCapabilityCache(),
+		health:     &printerHealth{},
+		diskLow:    &atomic.Bool{},
 
-		mu: &sync.Mutex{},
+		stableChecks:   1,
+		stableInterval: 3 * time.Second,
+		sortOrder:      sortName,
+		compression:    compressionNone,
+		metadataMode:   metadataFilename,
 
 		rootFolder:  rootFolder,
+		spool:       localStorage{root: rootFolder},
 		uploadPath:  fmt.Sprintf("%s/upload", rootFolder),
 		printedPath: fmt.Sprintf("%s/printed", rootFolder),
 		failedPath:  fmt.Sprintf("%s/failed", rootFolder),
-	}
 
-	if err := os.MkdirAll(ipm.uploadPath, 0755); err != nil {
-		return nil, err
-	}
-	if err := os.MkdirAll(ipm.printedPath, 0755); err != nil {
-		return nil, err
+		receiptsPath: fmt.Sprintf("%s/receipts", rootFolder),
+
+		unsupportedPath: fmt.Sprintf("%s/unsupported", rootFolder),
 	}
-	if err := os.MkdirAll(ipm.failedPath, 0755); err != nil {
-		return nil, err
+	ipm.settings.Store(&jobSettings{defaultJobAttrs: jobAttr})
+
+	for _, dir := range ipm.folders() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
 	}
 
 	return ipm, nil
 }
 
+// folders returns the folders the manager moves files between.
+func (i IppPrinterManager) folders() []string {
+	return []string{i.uploadPath, i.printedPath, i.failedPath}
+}
+
+// recreateFolders creates the folders again when they were deleted while
+// running, e.g. by a cleanup script, so that the watcher keeps working.
+func (i IppPrinterManager) recreateFolders() {
+	for _, dir := range i.folders() {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			continue
+		}
+
+		log.Printf("WARNING: %s was deleted, creating it again\n", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Failed to create %s: %s\n", dir, err)
+		}
+	}
+}
+
 func main() {
-	cfg, err := env.ParseAs[config]()
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Printf("%+v\n", err)
+		log.Printf("%+v\n", err)
 	}
+	// reloads are compared with the configuration as loaded, cfg is adjusted
+	// to the effective values below
+	loaded := cfg
 
-	client := ipp.NewIPPClient(cfg.IppHost, cfg.IppPort, cfg.IppUser, cfg.IppPass, cfg.IppTls)
+	if len(os.Args) > 1 && os.Args[1] == "retry-failed" {
+		if err := retryFailed(cfg.FileRootPath, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	jobAttrs := make(map[string]any)
-	if err := json.Unmarshal([]byte(cfg.IppJobAttrs), &jobAttrs); err != nil {
-		log.Printf("Failed to parse job attributes: %s\n", err)
+	var logs *logRing
+	if cfg.LogBuffer > 0 {
+		logs = newLogRing(cfg.LogBuffer)
+		log.SetOutput(io.MultiWriter(os.Stderr, logs))
 	}
 
-	ipm, err := NewIppPrinterManager(client, cfg.IppPrinter, cfg.FileRootPath, jobAttrs)
+	newAdapter := func(host string, port int) *httpAdapter {
+		a := newHttpAdapter(host, port, cfg.IppUser, cfg.IppPass, cfg.IppTls)
+		if cfg.MaxConns > 0 {
+			a.limitConns(cfg.MaxConns)
+		}
+		version, err := parseIppVersion(cfg.IppVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.version = version
+		a.autoDowngrade = cfg.IppDowngrade
+		if cfg.ProxyURL != "" {
+			if err := a.useProxy(cfg.ProxyURL); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if cfg.TlsCert != "" || cfg.TlsKey != "" {
+			if err := a.useClientCert(cfg.TlsCert, cfg.TlsKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return a
+	}
+
+	adapter := newAdapter(cfg.IppHost, cfg.IppPort)
+	adapter.followRedirects = cfg.FollowRedir
+	if cfg.IppSocket != "" {
+		if err := adapter.useSocket(cfg.IppSocket); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.MdnsName != "" {
+		service := "_ipp._tcp"
+		if cfg.IppTls {
+			service = "_ipps._tcp"
+		}
+		resolve := func() (mdnsTarget, error) {
+			return resolveMDNS(cfg.MdnsName, service, cfg.MdnsTimeout)
+		}
+
+		if t, err := resolve(); err != nil {
+			log.Printf("Failed to resolve printer %q via mDNS, using %s:%d: %s\n", cfg.MdnsName, cfg.IppHost, cfg.IppPort, err)
+		} else {
+			log.Printf("Resolved printer %q at %s:%d/%s\n", cfg.MdnsName, t.host, t.port, t.path)
+			if name, ok := strings.CutPrefix(t.path, "printers/"); ok {
+				cfg.IppPrinter = name
+				t.path = ""
+			}
+			adapter.setTarget(t)
+		}
+
+		if cfg.MdnsRetry {
+			adapter.resolve = resolve
+		}
+	}
+	client := ipp.NewIPPClientWithAdapter(cfg.IppUser, adapter)
+
+	settings, err := cfg.jobSettings()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if _, ok := settings.defaultJobAttrs[attributePageSet]; ok {
+		log.Printf("WARNING: PRINTER_PAGE_PARITY=%s also applies to the img.png banner\n", cfg.IppParity)
+	}
+
+	ipm, err := NewIppPrinterManager(client, cfg.IppPrinter, cfg.FileRootPath, settings.defaultJobAttrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ipm.settings.Store(settings)
+
+	if err := ipm.LoadCapabilities(); err != nil {
+		log.Printf("Failed to load printer capabilities: %s\n", err)
+	}
+
+	ipm.drainTimeout = cfg.DrainTimeout
+	ipm.adapter = adapter
+	if !slices.Contains(identifyActionValues, cfg.IdentifyAct) {
+		log.Fatalf("Invalid PRINTER_IDENTIFY_ACTION %q, expected %s\n", cfg.IdentifyAct, strings.Join(identifyActionValues, ", "))
+	}
+	ipm.identifyAction = cfg.IdentifyAct
+	ipm.latestRoots = cfg.LatestRoots
+
+	if len(os.Args) > 1 && os.Args[1] == "identify" {
+		if err := identifyCommand(ipm, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "print-latest" {
+		if err := printLatestCommand(ipm, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	ipm.useSeq = cfg.JobSequence
+	ipm.validate = cfg.ValidateJob
+	switch cfg.DupJobID {
+	case dupJobIDSuffix, dupJobIDIgnore:
+		ipm.dupJobIDPolicy = cfg.DupJobID
+	default:
+		log.Fatalf("Invalid PRINTER_DUP_JOBID_POLICY %q, expected suffix or ignore\n", cfg.DupJobID)
+	}
+	if cfg.StableChecks < 1 {
+		log.Fatalf("Invalid PRINTER_STABLE_CHECKS %d, expected at least 1\n", cfg.StableChecks)
+	}
+	ipm.stableChecks = cfg.StableChecks
+	ipm.stableInterval = cfg.StableIntvl
+	ipm.maxUploadAge = cfg.MaxUploadAge
+	ipm.retryJitter = cfg.RetryJitter
+	if _, ok := checksumAlgos[cfg.ChecksumAlgo]; cfg.ChecksumAlgo != "" && !ok {
+		log.Fatalf("Invalid PRINTER_CHECKSUM_ALGO %q, expected sha1, sha256 or sha512\n", cfg.ChecksumAlgo)
+	}
+	ipm.checksumAlgo = cfg.ChecksumAlgo
+	ipm.readXMP = cfg.ReadXMP
+	ipm.warnAsError = cfg.WarnAsError
+	switch cfg.MetadataMode {
+	case metadataFilename:
+	case metadataXattr, metadataBoth:
+		if !xattrSupported(ipm.printedPath) {
+			log.Printf("WARNING: %s does not support extended attributes, using PRINTER_METADATA_MODE=filename\n", ipm.printedPath)
+			cfg.MetadataMode = metadataFilename
+		}
+	default:
+		log.Fatalf("Invalid PRINTER_METADATA_MODE %q, expected filename, xattr or both\n", cfg.MetadataMode)
+	}
+	ipm.metadataMode = cfg.MetadataMode
+	switch cfg.SortOrder {
+	case sortName, sortMtimeAsc, sortMtimeDesc:
+		ipm.sortOrder = cfg.SortOrder
+	default:
+		log.Fatalf("Invalid PRINTER_SORT_ORDER %q, expected name, mtime-asc or mtime-desc\n", cfg.SortOrder)
+	}
+	switch cfg.Compression {
+	case compressionNone, "gzip", "deflate":
+		ipm.compression = cfg.Compression
+	default:
+		log.Fatalf("Invalid PRINTER_COMPRESSION %q, expected none, gzip or deflate\n", cfg.Compression)
+	}
+	if cfg.QrCover {
+		if qrEncoder == nil {
+			log.Fatalln("PRINTER_QR_COVER is not available in this build, build with -tags qr")
+		}
+		ipm.qrCover = cfg.QrURL
+	}
+	if cfg.Receipts {
+		switch cfg.ReceiptFmt {
+		case receiptPDF, receiptJSON:
+			ipm.receiptFmt = cfg.ReceiptFmt
+		default:
+			log.Fatalf("Invalid PRINTER_RECEIPT_FORMAT %q, expected pdf or json\n", cfg.ReceiptFmt)
+		}
+		if err := os.MkdirAll(ipm.receiptsPath, 0755); err != nil {
+			log.Fatal(err)
+		}
+		ipm.receipts = true
+	}
+	ipm.minFreeBytes = cfg.MinFree
+	ipm.pauseOnLowDisk = cfg.LowDiskPause
+	switch cfg.DocFormat {
+	case formatAuto, formatExtension:
+		ipm.formatMode = cfg.DocFormat
+	default:
+		log.Fatalf("Invalid PRINTER_DOCUMENT_FORMAT %q, expected auto or extension\n", cfg.DocFormat)
+	}
+	switch cfg.UserSource {
+	case userSourceClient, userSourceProcess, userSourceOwner, userSourceFilename:
+		ipm.userSource = cfg.UserSource
+	default:
+		log.Fatalf("Invalid PRINTER_USER_SOURCE %q, expected client, process, owner or filename\n", cfg.UserSource)
+	}
+	switch cfg.StartupAct {
+	case startupProcess, startupSkip, startupMoveToFailed:
+	default:
+		log.Fatalf("Invalid PRINTER_STARTUP_ACTION %q, expected process, skip or move-to-failed\n", cfg.StartupAct)
+	}
+	switch cfg.Unsupported {
+	case unsupportedSkip, unsupportedDelete:
+	case unsupportedMove:
+		if err := os.MkdirAll(ipm.unsupportedPath, 0755); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Invalid PRINTER_UNSUPPORTED_ACTION %q, expected skip, move or delete\n", cfg.Unsupported)
+	}
+	ipm.unsupportedAction = cfg.Unsupported
+	switch cfg.Completion {
+	case completionMove, completionMark:
+		ipm.completionMode = cfg.Completion
+	default:
+		log.Fatalf("Invalid PRINTER_COMPLETION_MODE %q, expected move or mark\n", cfg.Completion)
+	}
+	switch cfg.MoveOn {
+	case moveOnSubmit:
+	case moveOnComplete:
+		if cfg.PollWorkers < 1 {
+			log.Fatalln("PRINTER_MOVE_ON=complete requires PRINTER_POLL_WORKERS")
+		}
+	default:
+		log.Fatalf("Invalid PRINTER_MOVE_ON %q, expected submit or complete\n", cfg.MoveOn)
+	}
+	ipm.moveOn = cfg.MoveOn
+	if cfg.ProcTimeout > 0 && cfg.PollWorkers < 1 {
+		log.Fatalln("PRINTER_PROCESSING_TIMEOUT requires PRINTER_POLL_WORKERS")
+	}
+
+	if cfg.Pool != "" {
+		if ipm.pool, err = newPrinterPool(cfg.Pool, cfg.PoolMode, cfg.IppUser, newAdapter); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.PostOkCmd != "" || cfg.PostFailCmd != "" {
+		ipm.hooks = &postHooks{success: cfg.PostOkCmd, fail: cfg.PostFailCmd, timeout: cfg.HookTimeout, background: ipm.background}
+	}
+
+	if cfg.FailoverHost != "" {
+		if ipm.failover, err = newPoolMember(cfg.FailoverHost+"/"+cfg.FailoverName, cfg.IppUser, newAdapter); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.FailRetries < 0 {
+			log.Fatalf("Invalid PRINTER_FAILOVER_RETRIES %d, expected a retry count\n", cfg.FailRetries)
+		}
+		ipm.failoverRetries = cfg.FailRetries
+	}
+
+	if cfg.Source != "" {
+		if ipm.remote, err = newRemoteSource(cfg.Source, filepath.Join(cfg.FileRootPath, remoteStateFile)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.DecryptKey != "" {
+		if ipm.decryptKeys, err = loadDecryptionKeys(cfg.DecryptKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sink, err := newEventSink(cfg.EventSink, cfg.EventURL, cfg.EventSubject)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sink != nil {
+		ipm.events = newEventPublisher(sink, 256)
+	}
+
+	if err := ipm.handleLeftovers(cfg.StartupAct); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.CapsRefresh > 0 {
+		ipm.background.Go(func() { ipm.RefreshCapabilities(ctx, cfg.CapsRefresh) })
+	}
+
+	if cfg.PollWorkers > 0 {
+		ipm.poller = newJobPoller(client, adapter, cfg.PollWorkers, cfg.PollInterval)
+		ipm.poller.retries = cfg.PollRetries
+		ipm.poller.stuckAfter = cfg.ProcTimeout
+		ipm.poller.cancelStuck = cfg.CancelStuck
+		ipm.poller.Start(ctx, ipm.background)
+	}
+
+	reloader := &configReloader{cfg: loaded, ipm: ipm}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ipm.background.Go(func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if _, err := reloader.Reload(); err != nil {
+					log.Printf("Failed to reload configuration: %s\n", err)
+				}
+			}
+		}
+	})
+
+	srv := newHTTPServer(ipm, cfg.IdemTTL)
+	srv.maxQueueDepth = cfg.MaxQueue
+	srv.reloader = reloader
+	srv.logs = logs
+	ipm.background.Go(func() {
+		log.Printf("Starting HTTP server on port %d\n", cfg.Port)
+		if err := srv.ListenAndServe(ctx, fmt.Sprintf(":%d", cfg.Port)); err != nil {
+			log.Fatal(err)
+		}
+	})
 
 	log.Println("Starting file watcher")
 
-	if err := ipm.WatchFiles(context.Background()); err != nil {
+	if err := ipm.WatchFiles(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
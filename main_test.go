@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+const testPDF = "%PDF-1.4\n%%EOF\n"
+
+// fakeRequest is a request received by a fakePrinter, with its document
+// data.
+type fakeRequest struct {
+	*ipp.Request
+	data []byte
+}
+
+// fakePrinter is an IPP printer for tests. It accepts every request and
+// numbers the jobs it creates from 1, unless handle answers the request.
+type fakePrinter struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	requests []fakeRequest
+	lastID   int
+	// handle, when set, returns the response to req, or nil for the
+	// default one
+	handle func(req fakeRequest) *ipp.Response
+	// httpStatus fails the listed operations with an HTTP status
+	httpStatus map[int16]int
+	// unsupported answers the listed operations with
+	// successful-ok-ignored-or-substituted-attributes and an
+	// unsupported-attributes group naming the attributes
+	unsupported map[int16][]string
+}
+
+func newFakePrinter(t *testing.T) *fakePrinter {
+	p := &fakePrinter{httpStatus: make(map[int16]int), unsupported: make(map[int16][]string)}
+	p.srv = httptest.NewServer(http.HandlerFunc(p.serveHTTP))
+	t.Cleanup(p.srv.Close)
+
+	return p
+}
+
+func (p *fakePrinter) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var data bytes.Buffer
+	req, err := ipp.NewRequestDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fr := fakeRequest{Request: req, data: data.Bytes()}
+
+	p.mu.Lock()
+	p.requests = append(p.requests, fr)
+	status := p.httpStatus[req.Operation]
+	unsupported := p.unsupported[req.Operation]
+	handle := p.handle
+	p.mu.Unlock()
+
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	var resp *ipp.Response
+	if handle != nil {
+		resp = handle(fr)
+	}
+	if resp == nil {
+		resp = p.respond(fr)
+	}
+
+	if len(unsupported) > 0 {
+		resp.StatusCode = ipp.StatusOkIgnoredOrSubstituted
+	}
+	b, err := resp.Encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(unsupported) > 0 {
+		// go-ipp cannot encode the group; it goes before the end tag,
+		// the last byte of a response without data
+		group := []byte{byte(ipp.TagUnsupportedGroup)}
+		for _, name := range unsupported {
+			group = append(group, byte(ipp.TagUnsupportedValue))
+			group = binary.BigEndian.AppendUint16(group, uint16(len(name)))
+			group = append(append(group, name...), 0, 0)
+		}
+		end := len(b) - 1
+		b = append(b[:end:end], append(group, b[end:]...)...)
+	}
+	w.Write(b)
+}
+
+// respond returns the default response to req.
+func (p *fakePrinter) respond(req fakeRequest) *ipp.Response {
+	resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+
+	switch req.Operation {
+	case ipp.OperationCreateJob, ipp.OperationPrintJob:
+		p.mu.Lock()
+		p.lastID++
+		id := p.lastID
+		p.mu.Unlock()
+		resp.JobAttributes = []ipp.Attributes{jobIDAttrs(id)}
+	case ipp.OperationSendDocument:
+		id, _ := req.OperationAttributes[ipp.AttributeJobID].(int)
+		resp.JobAttributes = []ipp.Attributes{jobIDAttrs(id)}
+	case ipp.OperationGetJobAttributes:
+		resp.JobAttributes = []ipp.Attributes{{
+			ipp.AttributeJobState: {{Tag: ipp.TagEnum, Name: ipp.AttributeJobState, Value: int(ipp.JobStateCompleted)}},
+		}}
+	case ipp.OperationGetPrinterAttributes:
+		resp.PrinterAttributes = []ipp.Attributes{{
+			ipp.AttributePrinterName: {{Tag: ipp.TagName, Name: ipp.AttributePrinterName, Value: "P"}},
+		}}
+	}
+
+	return resp
+}
+
+func jobIDAttrs(id int) ipp.Attributes {
+	return ipp.Attributes{ipp.AttributeJobID: {{Tag: ipp.TagInteger, Name: ipp.AttributeJobID, Value: id}}}
+}
+
+// adapter returns an adapter sending requests to p.
+func (p *fakePrinter) adapter(t *testing.T) *httpAdapter {
+	u, err := url.Parse(p.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newHttpAdapter(u.Hostname(), port, "", "", false)
+}
+
+// received returns the requests of operation op received so far.
+func (p *fakePrinter) received(op int16) []fakeRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var reqs []fakeRequest
+	for _, r := range p.requests {
+		if r.Operation == op {
+			reqs = append(reqs, r)
+		}
+	}
+
+	return reqs
+}
+
+// newTestManager returns a manager printing to p with a root folder of its
+// own.
+func newTestManager(t *testing.T, p *fakePrinter) *IppPrinterManager {
+	adapter := p.adapter(t)
+	m, err := NewIppPrinterManager(ipp.NewIPPClientWithAdapter("svc", adapter), "P", t.TempDir(), map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.adapter = adapter
+
+	return m
+}
+
+// writeUpload writes a document named name into the upload folder of m.
+func writeUpload(t *testing.T, m *IppPrinterManager, name, content string) string {
+	file := filepath.Join(m.uploadPath, name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// folderFiles returns the names of the files in dir.
+func folderFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+func TestIsPrintable(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"/upload/a.pdf", true},
+		{"/upload/a.PDF", true},
+		{"/upload/a.pdf.age", true},
+		{"/upload/a.jpeg.gpg", true},
+		{"/upload/a@application-postscript.ps", true},
+		{"/upload/a@application-postscript.ps.age", true},
+		{"/upload/a.docx", false},
+		{"/upload/a.pdf.attrs.json", false},
+		{"/upload/a@application-postscript.ps.printed", false},
+	}
+	for _, tt := range tests {
+		if got := isPrintable(tt.file); got != tt.want {
+			t.Errorf("isPrintable(%q) = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestPDFHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		skipped int64
+	}{
+		{"no junk", testPDF, 0},
+		{"BOM", "\xef\xbb\xbf" + testPDF, 3},
+		{"HTTP headers", "Content-Type: application/pdf\r\n\r\n" + testPDF, 33},
+		{"end of window", strings.Repeat("x", pdfHeaderWindow-1) + testPDF, pdfHeaderWindow - 1},
+		{"beyond window", strings.Repeat("x", pdfHeaderWindow) + testPDF, 0},
+		{"no header", "not a pdf", 0},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.doc)
+			skipped, err := skipToPDFHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skipped != tt.skipped {
+				t.Errorf("skipToPDFHeader() = %d, want %d", skipped, tt.skipped)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.doc[tt.skipped:] {
+				t.Errorf("positioned at %q", rest)
+			}
+		})
+	}
+}
+
+func TestPDFTrailer(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		// pos is where the reader is positioned, after junk skipped
+		// before the header
+		pos  int64
+		want bool
+	}{
+		{"complete", testPDF, 0, true},
+		{"truncated", "%PDF-1.4\n1 0 obj\n<<", 0, false},
+		{"trailing whitespace", testPDF + " \r\n\t\f", 0, true},
+		{"trailing NULs", testPDF + strings.Repeat("\x00", 10), 0, true},
+		{"padding beyond window", testPDF + strings.Repeat("\x00", 3*pdfHeaderWindow), 0, true},
+		{"marker beyond window", testPDF + strings.Repeat("x", pdfHeaderWindow), 0, false},
+		{"incremental update", testPDF + "2 0 obj\n<< >>\nendobj\n%%EOF\n", 0, true},
+		{"truncated incremental update", testPDF + strings.Repeat("x", pdfHeaderWindow) + "\n2 0 obj\n<<", 0, false},
+		{"marker in skipped junk", "%%EOF\n%PDF-1.4\n1 0 obj", 6, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.doc)
+			if _, err := r.Seek(tt.pos, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := hasPDFTrailer(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("hasPDFTrailer() = %v, want %v", got, tt.want)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != tt.pos {
+				t.Errorf("position = %d, want %d", pos, tt.pos)
+			}
+		})
+	}
+}
+
+func TestSafeRename(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		dst      string
+		want     string
+	}{
+		{"free", nil, "a.pdf", "a.pdf"},
+		{"taken", []string{"a.pdf"}, "a.pdf", "a-1.pdf"},
+		{"taken twice", []string{"a.pdf", "a-1.pdf"}, "a.pdf", "a-2.pdf"},
+		{"gap", []string{"a.pdf", "a-2.pdf"}, "a.pdf", "a-1.pdf"},
+		{"no extension", []string{"a"}, "a", "a-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("existing"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			src := filepath.Join(dir, "src")
+			if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := safeRename(src, filepath.Join(dir, tt.dst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != filepath.Join(dir, tt.want) {
+				t.Errorf("safeRename() = %s, want %s", got, filepath.Join(dir, tt.want))
+			}
+			if b, _ := os.ReadFile(got); string(b) != "new" {
+				t.Errorf("%s holds %q, want the renamed file", got, b)
+			}
+			for _, name := range tt.existing {
+				if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != "existing" {
+					t.Errorf("%s was overwritten", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintMovesWithoutOverwriting(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   bool
+		folder func(m *IppPrinterManager) string
+	}{
+		{"printed", false, func(m *IppPrinterManager) string { return m.printedPath }},
+		{"failed", true, func(m *IppPrinterManager) string { return m.failedPath }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			if tt.fail {
+				p.httpStatus[ipp.OperationCreateJob] = http.StatusInternalServerError
+			}
+			m := newTestManager(t, p)
+			m.metadataMode = metadataXattr
+
+			dir := tt.folder(m)
+			if err := os.WriteFile(filepath.Join(dir, "a.pdf"), []byte("earlier"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := m.Print(writeUpload(t, m, "a.pdf", testPDF))
+			if (err != nil) != tt.fail {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			if b, _ := os.ReadFile(filepath.Join(dir, "a.pdf")); string(b) != "earlier" {
+				t.Errorf("a.pdf was overwritten")
+			}
+			if b, _ := os.ReadFile(filepath.Join(dir, "a-1.pdf")); string(b) != testPDF {
+				t.Errorf("a-1.pdf holds %q, want the printed document", b)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 1, 2 * time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{200 * time.Millisecond, 2, 800 * time.Millisecond},
+		{0, 4, 0},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.base, tt.attempt, false); got != tt.want {
+			t.Errorf("backoff(%s, %d, false) = %s, want %s", tt.base, tt.attempt, got, tt.want)
+		}
+		for n := 0; n < 20; n++ {
+			if got := backoff(tt.base, tt.attempt, true); got < 0 || got > tt.want || tt.want > 0 && got == tt.want {
+				t.Errorf("backoff(%s, %d, true) = %s, want [0, %s)", tt.base, tt.attempt, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSweepSkipsMarkedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		fail   bool
+		marker string
+	}{
+		{"printed", false, markerPrinted},
+		{"failed", true, markerFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			if tt.fail {
+				p.httpStatus[ipp.OperationCreateJob] = http.StatusInternalServerError
+			}
+			m := newTestManager(t, p)
+			m.completionMode = completionMark
+			m.stableChecks = 0
+			file := writeUpload(t, m, "a.pdf", testPDF)
+
+			m.sweep(context.Background(), file)
+			if _, err := os.Stat(file + tt.marker); err != nil {
+				t.Fatalf("no %s marker: %s", tt.marker, err)
+			}
+			delete(p.httpStatus, ipp.OperationCreateJob)
+			m.sweep(context.Background(), file)
+
+			if n := len(p.received(ipp.OperationCreateJob)); n != 1 {
+				t.Errorf("got %d Create-Job requests, want 1", n)
+			}
+			if _, err := os.Stat(file); err != nil {
+				t.Errorf("marked file was moved: %s", err)
+			}
+		})
+	}
+}
+
+// flakyStorage is a spool failing its first failures moves with err.
+type flakyStorage struct {
+	localStorage
+	failures int
+	err      error
+	moves    int
+}
+
+func (s *flakyStorage) Move(src, dst string) (string, error) {
+	s.moves++
+	if s.moves <= s.failures {
+		return "", &os.LinkError{Op: "rename", Old: src, New: dst, Err: s.err}
+	}
+
+	return s.localStorage.Move(src, dst)
+}
+
+func TestMoveRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		err       error
+		wantMoves int
+		wantMoved bool
+	}{
+		{"transient", 2, syscall.EBUSY, 3, true},
+		{"too many failures", 1, syscall.EBUSY, 2, false},
+		{"permanent", 2, syscall.EACCES, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			m := newTestManager(t, p)
+			m.metadataMode = metadataXattr
+			m.settings.Store(&jobSettings{moveRetries: tt.retries})
+			store := &flakyStorage{localStorage: localStorage{root: m.rootFolder}, failures: 2, err: tt.err}
+			m.spool = store
+			file := writeUpload(t, m, "a.pdf", testPDF)
+
+			err := m.Print(file)
+			if (err == nil) != tt.wantMoved {
+				t.Fatalf("Print() error = %v", err)
+			}
+			if store.moves != tt.wantMoves {
+				t.Errorf("%d move attempts, want %d", store.moves, tt.wantMoves)
+			}
+			if _, err := os.Stat(filepath.Join(m.printedPath, "a.pdf")); (err == nil) != tt.wantMoved {
+				t.Errorf("printed/a.pdf: %v", err)
+			}
+			if _, _, ok := submittedJob(file); ok == tt.wantMoved {
+				t.Errorf("submitted marker present: %v", ok)
+			}
+		})
+	}
+}
+
+func TestWaitStable(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks int
+		stable bool
+	}{
+		// a single check falls inside the pause of the copy
+		{"one check", 1, true},
+		{"consecutive checks", 4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, newFakePrinter(t))
+			m.stableChecks = tt.checks
+			m.stableInterval = 50 * time.Millisecond
+			file := writeUpload(t, m, "a.pdf", testPDF[:len(testPDF)/2])
+			info, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the copy stalls for more than one interval before the
+			// rest of the document arrives
+			done := make(chan error, 1)
+			go func() {
+				time.Sleep(120 * time.Millisecond)
+				f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					done <- err
+					return
+				}
+				_, err = f.WriteString(testPDF[len(testPDF)/2:])
+				f.Close()
+				done <- err
+			}()
+
+			stable, err := m.waitStable(context.Background(), file, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stable != tt.stable {
+				t.Errorf("waitStable() = %v, want %v", stable, tt.stable)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPrintIgnoredAttributes(t *testing.T) {
+	tests := []struct {
+		name        string
+		warnAsError bool
+		folder      func(m *IppPrinterManager) string
+		state       string
+	}{
+		{"warning", false, func(m *IppPrinterManager) string { return m.printedPath }, "printed"},
+		{"warning as error", true, func(m *IppPrinterManager) string { return m.failedPath }, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			p.unsupported[ipp.OperationCreateJob] = []string{attributeSides}
+			m := newTestManager(t, p)
+			m.metadataMode = metadataXattr
+			m.warnAsError = tt.warnAsError
+			m.receipts = true
+			m.receiptFmt = receiptJSON
+			if err := os.MkdirAll(m.receiptsPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			file := writeUpload(t, m, "a.pdf", testPDF)
+
+			if err := m.Print(file); (err != nil) != tt.warnAsError {
+				t.Fatalf("Print() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(tt.folder(m), "a.pdf")); err != nil {
+				t.Errorf("not moved: %s", err)
+			}
+
+			receipts := folderFiles(t, m.receiptsPath)
+			if len(receipts) != 1 {
+				t.Fatalf("receipts %v", receipts)
+			}
+			b, err := os.ReadFile(filepath.Join(m.receiptsPath, receipts[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r receipt
+			if err := json.Unmarshal(b, &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.State != tt.state || !slices.Equal(r.Ignored, []string{attributeSides}) {
+				t.Errorf("receipt state %s, ignored %v", r.State, r.Ignored)
+			}
+		})
+	}
+}
+
+func TestPrintReceiptOnCompletion(t *testing.T) {
+	tests := []struct {
+		name   string
+		final  int8
+		folder func(m *IppPrinterManager) string
+		state  string
+	}{
+		{"completed", ipp.JobStateCompleted, func(m *IppPrinterManager) string { return m.printedPath }, "printed"},
+		{"aborted", ipp.JobStateAborted, func(m *IppPrinterManager) string { return m.failedPath }, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var done atomic.Bool
+			p := newFakePrinter(t)
+			p.handle = func(req fakeRequest) *ipp.Response {
+				if req.Operation != ipp.OperationGetJobAttributes {
+					return nil
+				}
+				if !done.Load() {
+					return jobStateResponse(req, ipp.JobStateProcessing)
+				}
+				return jobStateResponse(req, tt.final)
+			}
+			m := newTestManager(t, p)
+			m.metadataMode = metadataXattr
+			m.moveOn = moveOnComplete
+			m.receipts = true
+			m.receiptFmt = receiptJSON
+			if err := os.MkdirAll(m.receiptsPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer m.background.Wait()
+			defer cancel()
+			m.poller = newJobPoller(m.client, m.adapter, 1, 10*time.Millisecond)
+			m.poller.Start(ctx, m.background)
+
+			file := writeUpload(t, m, "a.pdf", testPDF)
+			if err := m.Print(file); err != nil {
+				t.Fatalf("Print() error = %v", err)
+			}
+			if receipts := folderFiles(t, m.receiptsPath); len(receipts) != 0 {
+				t.Fatalf("receipts %v before the job is done", receipts)
+			}
+
+			done.Store(true)
+			for deadline := time.Now().Add(10 * time.Second); m.isAwaiting(file); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("job is not done")
+				}
+			}
+			if _, err := os.Stat(filepath.Join(tt.folder(m), "a.pdf")); err != nil {
+				t.Errorf("not moved: %s", err)
+			}
+
+			receipts := folderFiles(t, m.receiptsPath)
+			if len(receipts) != 1 {
+				t.Fatalf("receipts %v", receipts)
+			}
+			b, err := os.ReadFile(filepath.Join(m.receiptsPath, receipts[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r receipt
+			if err := json.Unmarshal(b, &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.State != tt.state || r.JobID != 1 || (r.Error != "") != (tt.state == "failed") {
+				t.Errorf("receipt %+v", r)
+			}
+		})
+	}
+}
+
+func TestSweepRetriesFailedMove(t *testing.T) {
+	p := newFakePrinter(t)
+	m := newTestManager(t, p)
+	m.metadataMode = metadataXattr
+	m.stableChecks = 0
+	store := &flakyStorage{localStorage: localStorage{root: m.rootFolder}, failures: 1, err: syscall.EBUSY}
+	m.spool = store
+	file := writeUpload(t, m, "a.pdf", testPDF)
+
+	if err := m.Print(file); err == nil {
+		t.Fatal("Print() moved the file")
+	}
+	m.sweep(context.Background(), file)
+
+	if n := len(p.received(ipp.OperationCreateJob)); n != 1 {
+		t.Errorf("got %d Create-Job requests, want 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(m.printedPath, "a.pdf")); err != nil {
+		t.Errorf("not moved: %s", err)
+	}
+	if _, _, ok := submittedJob(file); ok {
+		t.Error("submitted marker left behind")
+	}
+}
+
+func TestPrintCompressed(t *testing.T) {
+	tests := []struct {
+		name      string
+		supported []string
+		want      string
+	}{
+		{"supported", []string{compressionNone, "gzip"}, "gzip"},
+		{"unsupported", []string{compressionNone}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			m := newTestManager(t, p)
+			m.compression = "gzip"
+			var supported []ipp.Attribute
+			for _, c := range tt.supported {
+				supported = append(supported, ipp.Attribute{Tag: ipp.TagKeyword, Name: attributeCompressionSupported, Value: c})
+			}
+			m.caps.set(ipp.Attributes{attributeCompressionSupported: supported})
+
+			if err := m.Print(writeUpload(t, m, "a.pdf", testPDF)); err != nil {
+				t.Fatal(err)
+			}
+
+			send := p.received(ipp.OperationSendDocument)[0]
+			got, _ := send.OperationAttributes[attributeCompression].(string)
+			if got != tt.want {
+				t.Fatalf("compression = %q, want %q", got, tt.want)
+			}
+			data := send.data
+			if got == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(send.data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(data) != testPDF {
+				t.Errorf("printer received %q", data)
+			}
+		})
+	}
+}
+
+// documentRequests returns the Send-Document requests of the printed
+// document and of the banner.
+func documentRequests(t *testing.T, p *fakePrinter) (fakeRequest, fakeRequest) {
+	sends := p.received(ipp.OperationSendDocument)
+	if len(sends) != 2 {
+		t.Fatalf("got %d Send-Document requests, want 2", len(sends))
+	}
+
+	return sends[0], sends[1]
+}
+
+func TestDocumentOperationAttrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     string
+		want     string
+		password string
+		defaults map[string]any
+		sidecar  string
+	}{
+		{name: "password", attr: attributeDocumentPassword, want: "s3cret", password: "s3cret\n"},
+		{name: "language", attr: attributeDocumentLanguage, want: "th", defaults: map[string]any{attributeDocumentLanguage: "th"}},
+		{name: "language sidecar", attr: attributeDocumentLanguage, want: "de", defaults: map[string]any{attributeDocumentLanguage: "th"}, sidecar: `{"document-natural-language":"de"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			m := newTestManager(t, p)
+			if tt.defaults != nil {
+				m.settings.Store(&jobSettings{defaultJobAttrs: tt.defaults})
+			}
+			file := writeUpload(t, m, "a.pdf", testPDF)
+			if tt.password != "" {
+				if err := os.WriteFile(passwordSidecarPath(file), []byte(tt.password), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.sidecar != "" {
+				if err := os.WriteFile(sidecarAttrsPath(file), []byte(tt.sidecar), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := m.Print(file); err != nil {
+				t.Fatal(err)
+			}
+
+			doc, banner := documentRequests(t, p)
+			if got := doc.OperationAttributes[tt.attr]; got != tt.want {
+				t.Errorf("document Send-Document %s = %v, want %s", tt.attr, got, tt.want)
+			}
+			if _, ok := doc.JobAttributes[tt.attr]; ok {
+				t.Errorf("document Send-Document has %s in the job group", tt.attr)
+			}
+			if _, ok := banner.OperationAttributes[tt.attr]; ok {
+				t.Errorf("banner Send-Document has %s", tt.attr)
+			}
+			for _, create := range p.received(ipp.OperationCreateJob) {
+				_, op := create.OperationAttributes[tt.attr]
+				_, job := create.JobAttributes[tt.attr]
+				if op || job {
+					t.Errorf("Create-Job has %s", tt.attr)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintDocumentPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		wantFailed bool
+	}{
+		{"correct", "right", false},
+		{"incorrect", "wrong", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			p.handle = func(req fakeRequest) *ipp.Response {
+				if req.Operation != ipp.OperationSendDocument || req.OperationAttributes[ipp.AttributeDocumentName] != "statement.pdf" {
+					return nil
+				}
+				if req.OperationAttributes[attributeDocumentPassword] != "right" {
+					return ipp.NewResponse(ipp.StatusErrorDocumentPassword, req.RequestId)
+				}
+				return nil
+			}
+			m := newTestManager(t, p)
+			file := writeUpload(t, m, "statement.pdf", testPDF)
+			if err := os.WriteFile(passwordSidecarPath(file), []byte(tt.password), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := m.Print(file)
+			if (err != nil) != tt.wantFailed {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			dir, marker := m.printedPath, "_statement.pdf"
+			if tt.wantFailed {
+				dir, marker = m.failedPath, "_wrongpassword_statement.pdf"
+			}
+			names := folderFiles(t, dir)
+			if len(names) == 0 || !strings.HasSuffix(names[0], marker) {
+				t.Errorf("%s holds %v, want a file ending in %s", dir, names, marker)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/mdns"
+	"strings"
+	"time"
+)
+
+// mdnsTarget is a printer location resolved from a DNS-SD advertisement.
+type mdnsTarget struct {
+	host string
+	port int
+	// path is the resource path from the "rp" TXT record, e.g. "ipp/print"
+	// or "printers/Office".
+	path string
+}
+
+// resolveMDNS browses the local network for service ("_ipp._tcp" or
+// "_ipps._tcp") and returns the advertisement whose instance name is name.
+func resolveMDNS(name, service string, timeout time.Duration) (mdnsTarget, error) {
+	entries := make(chan *mdns.ServiceEntry, 64)
+
+	params := mdns.DefaultParams(service)
+	params.Entries = entries
+	params.Timeout = timeout
+	params.DisableIPv6 = true
+
+	if err := mdns.Query(params); err != nil {
+		return mdnsTarget{}, err
+	}
+	close(entries)
+
+	prefix := name + "." + service + "."
+	for e := range entries {
+		if !strings.HasPrefix(strings.ReplaceAll(e.Name, `\ `, " "), prefix) {
+			continue
+		}
+
+		t := mdnsTarget{host: e.Host, port: e.Port}
+		if e.AddrV4 != nil {
+			t.host = e.AddrV4.String()
+		}
+		for _, f := range e.InfoFields {
+			if rp, ok := strings.CutPrefix(f, "rp="); ok {
+				t.path = rp
+			}
+		}
+
+		return t, nil
+	}
+
+	return mdnsTarget{}, fmt.Errorf("no %s service named %q found", service, name)
+}
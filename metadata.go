@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	metadataFilename = "filename"
+	metadataXattr    = "xattr"
+	metadataBoth     = "both"
+
+	// xattrPrefix namespaces the extended attributes written on completed
+	// files, e.g. user.print.job_id.
+	xattrPrefix = "user.print."
+)
+
+// namesCarryMetadata reports whether the date, job-id and failure reason
+// are encoded in the names of completed files.
+func (i IppPrinterManager) namesCarryMetadata() bool {
+	return i.metadataMode != metadataXattr
+}
+
+// writeMetadata records the job-id, the printer that took the job, time and
+// final state of a completed file as extended attributes when the metadata
+// mode asks for them. Failures are logged and do not affect the file.
+func (i IppPrinterManager) writeMetadata(file, jobID, printer, state string, printErr error) {
+	if i.metadataMode != metadataXattr && i.metadataMode != metadataBoth {
+		return
+	}
+
+	attrs := map[string]string{
+		"job_id":  jobID,
+		"printer": printer,
+		"time":    time.Now().Format(time.RFC3339),
+		"state":   state,
+	}
+	if printErr != nil {
+		attrs["error"] = printErr.Error()
+	}
+
+	for k, v := range attrs {
+		if v == "" {
+			continue
+		}
+		if err := syscall.Setxattr(file, xattrPrefix+k, []byte(v), 0); err != nil {
+			log.Printf("Failed to write %s%s on %s: %s\n", xattrPrefix, k, file, err)
+			return
+		}
+	}
+}
+
+// xattrSupported reports whether files in dir can carry user extended
+// attributes.
+func xattrSupported(dir string) bool {
+	f, err := os.CreateTemp(dir, ".xattr-probe-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	return syscall.Setxattr(f.Name(), xattrPrefix+"probe", []byte("1"), 0) == nil
+}
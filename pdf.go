@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pdfHeaderWindow is how far into a PDF the %PDF- marker is searched for,
+// and how far before its end the %%EOF marker.
+const pdfHeaderWindow = 1024
+
+var (
+	pdfHeader  = []byte("%PDF-")
+	pdfTrailer = []byte("%%EOF")
+)
+
+// pdfPadding are the bytes writers may append after the %%EOF marker.
+const pdfPadding = "\x00\t\n\f\r "
+
+// skipToPDFHeader positions r at the %PDF- marker when a UTF-8 BOM, HTTP
+// headers or other junk was prepended to the document, and returns the
+// number of bytes skipped. When the marker does not start in the first
+// pdfHeaderWindow bytes r is left at the start and the printer decides what
+// to do with the document.
+func skipToPDFHeader(r io.ReadSeeker) (int64, error) {
+	// a marker starting at the end of the window is read in full
+	buf := make([]byte, pdfHeaderWindow+len(pdfHeader)-1)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+
+	offset := int64(bytes.Index(buf[:n], pdfHeader))
+	if offset < 0 {
+		offset = 0
+	}
+
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// hasPDFTrailer reports whether the %%EOF marker is in the last
+// pdfHeaderWindow bytes of r, not counting whitespace and NULs padding the
+// end, which catches documents truncated by an interrupted upload or
+// writer. Documents with incremental updates have a marker after every
+// update; the last one is found. The position of r is preserved.
+func hasPDFTrailer(r io.ReadSeeker) (bool, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	// the padding may be longer than the window
+	var tail []byte
+	for end > pos {
+		start := max(pos, end-pdfHeaderWindow)
+		chunk, err := readPDFRange(r, start, end)
+		if err != nil {
+			return false, err
+		}
+		if trimmed := bytes.TrimRight(chunk, pdfPadding); len(trimmed) > 0 {
+			end = start + int64(len(trimmed))
+			tail = trimmed
+			break
+		}
+		end = start
+	}
+	if start := max(pos, end-pdfHeaderWindow); end-int64(len(tail)) > start {
+		if tail, err = readPDFRange(r, start, end); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	return bytes.Contains(tail, pdfTrailer), nil
+}
+
+// readPDFRange reads the bytes of r from start to end.
+func readPDFRange(r io.ReadSeeker, start, end int64) ([]byte, error) {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, end-start)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// isPDF reports whether name has a .pdf extension.
+func isPDF(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".pdf")
+}
+
+// Layout of the pages written by textPDF: A4 in points, 10pt Courier.
+const (
+	textPDFWidth   = 595
+	textPDFHeight  = 842
+	textPDFMargin  = 50
+	textPDFLeading = 13
+	textPDFColumns = 82
+)
+
+// textPDF returns a PDF document showing lines in a monospaced font, on as
+// many A4 pages as needed. Long lines are wrapped and characters outside
+// Latin-1 are replaced with "?".
+func textPDF(lines []string) []byte {
+	var wrapped []string
+	for _, l := range lines {
+		r := []rune(l)
+		for len(r) > textPDFColumns {
+			wrapped = append(wrapped, string(r[:textPDFColumns]))
+			r = r[textPDFColumns:]
+		}
+		wrapped = append(wrapped, string(r))
+	}
+
+	perPage := (textPDFHeight - 2*textPDFMargin) / textPDFLeading
+	var pages [][]string
+	for len(wrapped) > perPage {
+		pages = append(pages, wrapped[:perPage])
+		wrapped = wrapped[perPage:]
+	}
+	pages = append(pages, wrapped)
+
+	// objects 1 and 2 are the catalog and the page tree, 3 is the font and
+	// every page is followed by its content stream
+	objects := []string{"", "", "<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>"}
+	var kids []string
+	for _, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 10 Tf %d TL %d %d Td\n", textPDFLeading, textPDFMargin, textPDFHeight-textPDFMargin)
+		for _, l := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfString(l))
+		}
+		content.WriteString("ET")
+
+		n := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", textPDFWidth, textPDFHeight, n+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.Bytes()),
+		)
+	}
+	objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for n, obj := range objects {
+		offsets[n] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", n+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return b.Bytes()
+}
+
+// pdfString escapes s for a PDF literal string in WinAnsiEncoding.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r >= 0x7f && r < 0xa0 || r > 0xff:
+			b.WriteByte('?')
+		case r > 0x7f:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
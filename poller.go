@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const attributeJobStateReasons = "job-state-reasons"
+
+// pollState is the last known state of a submitted job.
+type pollState struct {
+	JobID     int       `json:"job_id"`
+	File      string    `json:"file"`
+	State     int       `json:"state"`
+	Reasons   []string  `json:"reasons,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Updated   time.Time `json:"updated"`
+	// Stuck is set once the job has been processing for longer than the
+	// processing timeout, which usually means the printer is jammed or hung
+	Stuck bool `json:"stuck,omitempty"`
+	// Untracked is set when polling gave up after repeated failures; the
+	// state of the job is unknown and it may still print
+	Untracked bool `json:"untracked,omitempty"`
+
+	processingSince time.Time
+	onDone          func(pollState)
+	// user is the requesting-user-name the job was submitted as
+	user string
+}
+
+// done reports whether the job reached a terminal state.
+func (s pollState) done() bool {
+	return s.State >= int(ipp.JobStateCanceled)
+}
+
+// jobPoller tracks submitted jobs with Get-Job-Attributes until they reach a
+// terminal state. Each of its workers follows one job at a time, so up to
+// workers jobs are polled concurrently, independent of submission.
+type jobPoller struct {
+	client   *ipp.IPPClient
+	adapter  *httpAdapter
+	workers  int
+	interval time.Duration
+	queue    chan int
+	// stop makes one worker exit once it is idle, see Resize
+	stop chan struct{}
+
+	ctx        context.Context
+	background *lifecycle
+
+	// stuckAfter is how long a job may stay processing before it is
+	// flagged as stuck, zero disabling the check; cancelStuck cancels it
+	stuckAfter  time.Duration
+	cancelStuck bool
+
+	// retries is how many consecutive failed polls of a job are retried
+	// before it is no longer tracked
+	retries int
+
+	mu     sync.Mutex
+	states map[int]*pollState
+}
+
+func newJobPoller(client *ipp.IPPClient, adapter *httpAdapter, workers int, interval time.Duration) *jobPoller {
+	return &jobPoller{
+		client:   client,
+		adapter:  adapter,
+		workers:  workers,
+		interval: interval,
+		queue:    make(chan int, 1024),
+		stop:     make(chan struct{}, 1024),
+		states:   make(map[int]*pollState),
+	}
+}
+
+// Start launches the poll workers in background. They exit when ctx is
+// done.
+func (p *jobPoller) Start(ctx context.Context, background *lifecycle) {
+	p.ctx, p.background = ctx, background
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for w := 0; w < p.workers; w++ {
+		p.startWorker()
+	}
+}
+
+func (p *jobPoller) startWorker() {
+	p.background.Go(func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.stop:
+				return
+			case jobID := <-p.queue:
+				p.follow(p.ctx, jobID)
+			}
+		}
+	})
+}
+
+// Resize changes the number of poll workers of a started poller to n. Extra
+// workers are stopped once they are done with the job they follow, and
+// queued jobs wait for the remaining ones.
+func (p *jobPoller) Resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ctx.Err() != nil {
+		return
+	}
+	for ; p.workers < n; p.workers++ {
+		p.startWorker()
+	}
+	for ; p.workers > n; p.workers-- {
+		p.stop <- struct{}{}
+	}
+}
+
+// Track starts following jobID, submitted as user, and reports whether it is
+// followed. onDone, when not nil, is called once the job reaches a terminal
+// state. It is a no-op on a nil poller.
+func (p *jobPoller) Track(jobID int, file, user string, onDone func(pollState)) bool {
+	if p == nil {
+		return false
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	for id, s := range p.states {
+		if (s.done() || s.Untracked) && now.Sub(s.Updated) > time.Hour {
+			delete(p.states, id)
+		}
+	}
+	p.states[jobID] = &pollState{JobID: jobID, File: file, State: int(ipp.JobStatePending), Submitted: now, Updated: now, onDone: onDone, user: user}
+	p.mu.Unlock()
+
+	select {
+	case p.queue <- jobID:
+		return true
+	default:
+		log.Printf("Job poll queue full, not tracking job %d\n", jobID)
+		return false
+	}
+}
+
+// State returns the last known state of jobID.
+func (p *jobPoller) State(jobID int) (pollState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.states[jobID]
+	if !ok {
+		return pollState{}, false
+	}
+
+	return *s, true
+}
+
+func (p *jobPoller) follow(ctx context.Context, jobID int) {
+	s, _ := p.State(jobID)
+	failures := 0
+	for {
+		if p.poll(jobID, s.user, &failures) {
+			return
+		}
+
+		if !sleepCtx(ctx, p.interval) {
+			return
+		}
+	}
+}
+
+// poll fetches the state of jobID once and reports whether following it is
+// over, because the job finished or polling it failed more than retries
+// times in a row. failures counts the consecutive failed polls.
+func (p *jobPoller) poll(jobID int, user string, failures *int) bool {
+	attrs, err := p.jobState(jobID, user)
+	if err != nil {
+		// a failed poll says nothing about the job itself
+		*failures++
+		if *failures <= p.retries {
+			log.Printf("Failed to poll job %d, retrying (%d/%d): %s\n", jobID, *failures, p.retries, err)
+			return false
+		}
+
+		s := p.untrack(jobID)
+		log.Printf("Giving up on polling job %d (%s) after %d failures, its state is unknown and it may still print: %s\n", jobID, s.File, *failures, err)
+		if s.onDone != nil {
+			s.onDone(s)
+		}
+		return true
+	}
+	*failures = 0
+
+	s := p.update(jobID, attrs)
+	if s.done() {
+		log.Printf("Job %d (%s) finished with state %d %v\n", jobID, s.File, s.State, s.Reasons)
+		if s.onDone != nil {
+			s.onDone(s)
+		}
+		return true
+	}
+
+	if p.markStuck(jobID) {
+		log.Printf("ALERT: job %d (%s) has been processing for more than %s, the printer may be hung %v\n", jobID, s.File, p.stuckAfter, s.Reasons)
+		if p.cancelStuck {
+			if err := p.cancel(jobID, user); err != nil {
+				log.Printf("Failed to cancel stuck job %d: %s\n", jobID, err)
+			}
+		}
+	}
+
+	return false
+}
+
+// jobRequest returns a request for op on jobID, made as user when it is
+// set. Printers such as CUPS only let the owner of a job act on it, so every
+// request about a job carries the user it was submitted as.
+func jobRequest(op int16, jobID int, user string) *ipp.Request {
+	req := ipp.NewRequest(op, 1)
+	req.OperationAttributes[ipp.AttributeJobURI] = fmt.Sprintf("ipp://localhost/jobs/%d", jobID)
+	if user != "" {
+		req.OperationAttributes[ipp.AttributeRequestingUserName] = user
+	}
+
+	return req
+}
+
+// jobState fetches the job-state and job-state-reasons of jobID as user.
+func (p *jobPoller) jobState(jobID int, user string) (ipp.Attributes, error) {
+	req := jobRequest(ipp.OperationGetJobAttributes, jobID, user)
+	req.OperationAttributes[ipp.AttributeRequestedAttributes] = []string{ipp.AttributeJobState, attributeJobStateReasons}
+
+	resp, err := p.client.SendRequest(p.adapter.GetHttpUri("jobs", jobID), req, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.JobAttributes) == 0 {
+		return nil, errors.New("printer returned no job attributes")
+	}
+
+	return resp.JobAttributes[0], nil
+}
+
+// cancel cancels jobID as user.
+func (p *jobPoller) cancel(jobID int, user string) error {
+	return cancelJob(p.client, p.adapter, jobID, user)
+}
+
+// untrack records that jobID is no longer polled.
+func (p *jobPoller) untrack(jobID int) pollState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.states[jobID]
+	s.Untracked = true
+	s.Updated = time.Now()
+
+	return *s
+}
+
+func (p *jobPoller) update(jobID int, attrs ipp.Attributes) pollState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.states[jobID]
+	if v := attrs[ipp.AttributeJobState]; len(v) > 0 {
+		if state, ok := v[0].Value.(int); ok {
+			s.State = state
+		}
+	}
+	switch {
+	case s.State != int(ipp.JobStateProcessing):
+		s.processingSince = time.Time{}
+	case s.processingSince.IsZero():
+		s.processingSince = time.Now()
+	}
+	s.Reasons = s.Reasons[:0]
+	for _, r := range attrs[attributeJobStateReasons] {
+		if reason, ok := r.Value.(string); ok {
+			s.Reasons = append(s.Reasons, reason)
+		}
+	}
+	s.Updated = time.Now()
+
+	return *s
+}
+
+// markStuck flags jobID as stuck when it has been processing for longer than
+// stuckAfter. It reports whether the job was newly flagged.
+func (p *jobPoller) markStuck(jobID int) bool {
+	if p.stuckAfter <= 0 {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.states[jobID]
+	if s.Stuck || s.processingSince.IsZero() || time.Since(s.processingSince) < p.stuckAfter {
+		return false
+	}
+	s.Stuck = true
+
+	return true
+}
+
+// Stuck returns the jobs flagged as stuck that have not finished yet. It
+// returns nil on a nil poller.
+func (p *jobPoller) Stuck() []pollState {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var stuck []pollState
+	for _, s := range p.states {
+		if s.Stuck && !s.done() && !s.Untracked {
+			stuck = append(stuck, *s)
+		}
+	}
+	slices.SortFunc(stuck, func(a, b pollState) int { return a.JobID - b.JobID })
+
+	return stuck
+}
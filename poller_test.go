@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// startPoller starts a poller of p with workers workers until the test
+// ends.
+func startPoller(t *testing.T, p *fakePrinter, workers int) *jobPoller {
+	adapter := p.adapter(t)
+	poller := newJobPoller(ipp.NewIPPClientWithAdapter("svc", adapter), adapter, workers, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	background := &lifecycle{}
+	poller.Start(ctx, background)
+	t.Cleanup(func() {
+		cancel()
+		background.Wait()
+	})
+
+	return poller
+}
+
+func jobStateResponse(req fakeRequest, state int8) *ipp.Response {
+	resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+	resp.JobAttributes = []ipp.Attributes{{
+		ipp.AttributeJobState: {{Tag: ipp.TagEnum, Name: ipp.AttributeJobState, Value: int(state)}},
+	}}
+
+	return resp
+}
+
+// requestJobID returns the job-id in the job-uri of req.
+func requestJobID(req fakeRequest) int {
+	uri, _ := req.OperationAttributes[ipp.AttributeJobURI].(string)
+	id, _ := strconv.Atoi(strings.TrimPrefix(uri, "ipp://localhost/jobs/"))
+
+	return id
+}
+
+func TestPollerFollowsJobsConcurrently(t *testing.T) {
+	final := map[int]int8{1: ipp.JobStateCompleted, 2: ipp.JobStateAborted, 3: ipp.JobStateCanceled}
+
+	// every poll waits until all jobs are polled at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(len(final))
+	concurrent := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(concurrent)
+	}()
+	var polled sync.Map
+
+	p := newFakePrinter(t)
+	p.handle = func(req fakeRequest) *ipp.Response {
+		if req.Operation != ipp.OperationGetJobAttributes {
+			return nil
+		}
+		id := requestJobID(req)
+		if _, seen := polled.LoadOrStore(id, true); !seen {
+			arrived.Done()
+		}
+		select {
+		case <-concurrent:
+		case <-time.After(5 * time.Second):
+		}
+		return jobStateResponse(req, final[id])
+	}
+	poller := startPoller(t, p, len(final))
+
+	var done sync.WaitGroup
+	done.Add(len(final))
+	for id := range final {
+		if !poller.Track(id, "job.pdf", "", func(pollState) { done.Done() }) {
+			t.Fatalf("job %d not tracked", id)
+		}
+	}
+	done.Wait()
+
+	select {
+	case <-concurrent:
+	default:
+		t.Error("jobs were not polled concurrently")
+	}
+	for id, want := range final {
+		s, ok := poller.State(id)
+		if !ok || s.State != int(want) {
+			t.Errorf("job %d state = %d, want %d", id, s.State, want)
+		}
+	}
+}
+
+func TestPollerRetriesFailedPolls(t *testing.T) {
+	tests := []struct {
+		name          string
+		retries       int
+		failures      int
+		wantUntracked bool
+	}{
+		{"transient", 2, 2, false},
+		{"persistent", 2, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			p := newFakePrinter(t)
+			p.handle = func(req fakeRequest) *ipp.Response {
+				if req.Operation != ipp.OperationGetJobAttributes {
+					return nil
+				}
+				mu.Lock()
+				polls++
+				n := polls
+				mu.Unlock()
+				if n <= tt.failures {
+					return ipp.NewResponse(ipp.StatusErrorServiceUnavailable, req.RequestId)
+				}
+				return jobStateResponse(req, ipp.JobStateCompleted)
+			}
+			poller := startPoller(t, p, 1)
+			poller.retries = tt.retries
+
+			states := make(chan pollState, 1)
+			poller.Track(1, "job.pdf", "", func(s pollState) { states <- s })
+			s := <-states
+
+			if s.Untracked != tt.wantUntracked {
+				t.Errorf("Untracked = %v, want %v", s.Untracked, tt.wantUntracked)
+			}
+			if !tt.wantUntracked && s.State != int(ipp.JobStateCompleted) {
+				t.Errorf("state = %d, want completed", s.State)
+			}
+		})
+	}
+}
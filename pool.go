@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	poolRoundRobin = "round-robin"
+	poolLeastBusy  = "least-busy"
+
+	// poolDownFor is how long a pool member that failed is skipped.
+	poolDownFor = 30 * time.Second
+)
+
+// poolMember is one printer of a printerPool, or the failover printer.
+type poolMember struct {
+	addr      string
+	printer   string
+	client    *ipp.IPPClient
+	adapter   *httpAdapter
+	downUntil time.Time
+}
+
+// uri returns the URI of the member's printer.
+func (m *poolMember) uri() string {
+	return m.adapter.GetHttpUri("printers", m.printer)
+}
+
+// printerPool spreads jobs over several identical printers configured with
+// PRINTER_POOL. Members that fail are skipped for poolDownFor.
+type printerPool struct {
+	mode string
+
+	mu      sync.Mutex
+	members []*poolMember
+	next    int
+}
+
+// newPrinterPool parses a comma separated list of host[:port]/printer
+// entries. newAdapter creates the adapter of each member so members share
+// the credentials and TLS settings of the primary printer.
+func newPrinterPool(spec, mode, user string, newAdapter func(host string, port int) *httpAdapter) (*printerPool, error) {
+	if mode != poolRoundRobin && mode != poolLeastBusy {
+		return nil, fmt.Errorf("invalid PRINTER_POOL_MODE %q, expected round-robin or least-busy", mode)
+	}
+
+	p := &printerPool{mode: mode}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		m, err := newPoolMember(entry, user, newAdapter)
+		if err != nil {
+			return nil, err
+		}
+		p.members = append(p.members, m)
+	}
+	if len(p.members) == 0 {
+		return nil, errors.New("PRINTER_POOL has no members")
+	}
+
+	return p, nil
+}
+
+// newPoolMember parses a host[:port]/printer entry.
+func newPoolMember(entry, user string, newAdapter func(host string, port int) *httpAdapter) (*poolMember, error) {
+	addr, printer, ok := strings.Cut(entry, "/")
+	if !ok || printer == "" {
+		return nil, fmt.Errorf("invalid printer %q, expected host[:port]/printer", entry)
+	}
+
+	host, port := addr, 631
+	if h, ps, err := net.SplitHostPort(addr); err == nil {
+		if port, err = strconv.Atoi(ps); err != nil {
+			return nil, fmt.Errorf("invalid port in printer %q", entry)
+		}
+		host = h
+	}
+
+	adapter := newAdapter(host, port)
+
+	return &poolMember{
+		addr:    addr,
+		printer: printer,
+		client:  ipp.NewIPPClientWithAdapter(user, adapter),
+		adapter: adapter,
+	}, nil
+}
+
+// pick returns the member the next job should go to, skipping members for
+// which ready reports false. It returns nil without an error when members
+// are up but none is ready, so that the job waits.
+func (p *printerPool) pick(ready func(*poolMember) bool) (*poolMember, error) {
+	return p.choose(true, ready)
+}
+
+// peek returns the member pick would return, without moving on to the next
+// member in round-robin mode or checking whether it is ready.
+func (p *printerPool) peek() (*poolMember, error) {
+	return p.choose(false, nil)
+}
+
+func (p *printerPool) choose(advance bool, ready func(*poolMember) bool) (*poolMember, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var up []*poolMember
+	waiting := false
+	for n := range p.members {
+		idx := (p.next + n) % len(p.members)
+		m := p.members[idx]
+		if !now.After(m.downUntil) {
+			continue
+		}
+		if ready != nil && !ready(m) {
+			waiting = true
+			continue
+		}
+		if p.mode == poolRoundRobin {
+			if advance {
+				p.next = idx + 1
+			}
+			return m, nil
+		}
+		up = append(up, m)
+	}
+	if len(up) == 0 && waiting {
+		return nil, nil
+	}
+	if len(up) == 0 {
+		return nil, errors.New("no printer of the pool is available")
+	}
+
+	var best *poolMember
+	bestQueued := 0
+	for _, m := range up {
+		attrs, err := m.client.GetPrinterAttributes(m.printer, []string{attributeQueuedJobCount})
+		if err != nil {
+			log.Printf("Pool printer %s/%s is unavailable: %s\n", m.addr, m.printer, err)
+			m.downUntil = now.Add(poolDownFor)
+			continue
+		}
+
+		// a printer that does not report its queue counts as idle
+		n, _ := queuedJobCount(attrs)
+		if best == nil || n < bestQueued {
+			best, bestQueued = m, n
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no printer of the pool is available")
+	}
+
+	return best, nil
+}
+
+// member returns the member named name, given as host[:port]/printer or as
+// a printer name that only one member has.
+func (p *printerPool) member(name string) (*poolMember, error) {
+	var found []*poolMember
+	for _, m := range p.members {
+		if m.addr+"/"+m.printer == name {
+			return m, nil
+		}
+		if m.printer == name {
+			found = append(found, m)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("unknown printer %q", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("printer %q is ambiguous, use host[:port]/printer", name)
+	}
+}
+
+// sidecarPrinterKey is the sidecar entry naming the printer an upload was
+// sent to with the X-Printer header. It is not a job attribute and never
+// sent to the printer.
+const sidecarPrinterKey = "printer"
+
+// primaryPrinter returns the name of the configured printer, following a
+// redirect of its queue.
+func (i IppPrinterManager) primaryPrinter() string {
+	return i.adapter.queueName(i.printerName)
+}
+
+// printerFor resolves a printer requested by name: a member of the pool, or
+// without a pool the configured printer, for which it returns nil.
+func (i IppPrinterManager) printerFor(name string) (*poolMember, error) {
+	if i.pool != nil {
+		return i.pool.member(name)
+	}
+	if name != i.printerName && name != i.primaryPrinter() {
+		return nil, fmt.Errorf("unknown printer %q", name)
+	}
+
+	return nil, nil
+}
+
+// sidecarPrinter returns the printer requested by sidecarAttrs, if any, and
+// removes the entry.
+func (i IppPrinterManager) sidecarPrinter(sidecarAttrs map[string]any) (*poolMember, error) {
+	v, ok := sidecarAttrs[sidecarPrinterKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(sidecarAttrs, sidecarPrinterKey)
+
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid printer %v in sidecar", v)
+	}
+
+	return i.printerFor(name)
+}
+
+// markDown skips m for poolDownFor after a failed submission.
+func (p *printerPool) markDown(m *poolMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	log.Printf("Pool printer %s/%s failed, skipping it for %s: %s\n", m.addr, m.printer, poolDownFor, err)
+	m.downUntil = time.Now().Add(poolDownFor)
+}
+
+// printPool submits docs as user to m, a member of the pool.
+func (i IppPrinterManager) printPool(m *poolMember, docs []ipp.Document, ja map[string]any, user string) (int, error) {
+	jId, err := submit(m.client, m.adapter, docs, m.printer, ja, user)
+	if err != nil {
+		// only transport failures say something about the printer's health
+		if c, _ := errorCategory(submitError(err)); c != CategoryPrinterRejected {
+			i.pool.markDown(m, err)
+		}
+		return -1, err
+	}
+
+	log.Printf("Submitted job %d to pool printer %s/%s\n", jId, m.addr, m.printer)
+
+	return jId, nil
+}
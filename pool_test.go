@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// newTestPool returns a pool of printers, named P1, P2 and so on.
+func newTestPool(t *testing.T, mode string, printers ...*fakePrinter) *printerPool {
+	var spec []string
+	for n, p := range printers {
+		u, err := url.Parse(p.srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec = append(spec, fmt.Sprintf("%s/P%d", u.Host, n+1))
+	}
+
+	pool, err := newPrinterPool(strings.Join(spec, ","), mode, "svc", func(host string, port int) *httpAdapter {
+		return newHttpAdapter(host, port, "", "", false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+// rejectValidateJob makes p reject every Validate-Job request.
+func rejectValidateJob(p *fakePrinter) {
+	p.handle = func(req fakeRequest) *ipp.Response {
+		if req.Operation != ipp.OperationValidateJob {
+			return nil
+		}
+		return ipp.NewResponse(ipp.StatusErrorAttributesOrValues, req.RequestId)
+	}
+}
+
+func TestValidateJobPoolMember(t *testing.T) {
+	tests := []struct {
+		name string
+		// printer is the printer requested by the upload, none to let
+		// the pool pick P1
+		printer    string
+		reject     int
+		validated  int
+		wantFailed bool
+	}{
+		{"requested member", "P1", 2, 1, false},
+		{"requested member rejects", "P2", 2, 2, true},
+		{"picked member rejects", "", 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printers := []*fakePrinter{newFakePrinter(t), newFakePrinter(t)}
+			rejectValidateJob(printers[tt.reject-1])
+			m := newTestManager(t, newFakePrinter(t))
+			m.metadataMode = metadataXattr
+			m.validate = true
+			m.pool = newTestPool(t, poolRoundRobin, printers...)
+
+			attrs := map[string]any{}
+			if tt.printer != "" {
+				attrs[sidecarPrinterKey] = tt.printer
+			}
+			file := writeUpload(t, m, "a.pdf", testPDF)
+			if err := writeSidecarAttrs(file, attrs); err != nil {
+				t.Fatal(err)
+			}
+
+			// the validate endpoint and the preflight of Print ask the
+			// printer the job goes to
+			if report := m.validateDocument(file, maps.Clone(attrs)); report.Printable == tt.wantFailed {
+				t.Errorf("validateDocument() = %+v", report)
+			}
+			if err := m.Print(file); (err != nil) != tt.wantFailed {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			for n, p := range printers {
+				wantValidations := 0
+				if n == tt.validated-1 {
+					wantValidations = 2
+				}
+				if got := len(p.received(ipp.OperationValidateJob)); got != wantValidations {
+					t.Errorf("P%d got %d Validate-Job requests, want %d", n+1, got, wantValidations)
+				}
+			}
+			jobs := len(printers[0].received(ipp.OperationCreateJob)) + len(printers[1].received(ipp.OperationCreateJob))
+			wantJobs := 1
+			if tt.wantFailed {
+				wantJobs = 0
+			}
+			if jobs != wantJobs {
+				t.Errorf("got %d Create-Job requests, want %d", jobs, wantJobs)
+			}
+		})
+	}
+}
+
+func init() {
+	// fake printers report the queue of least-busy pools; go-ipp can only
+	// encode attributes it knows the tag of
+	ipp.AttributeTagMapping[attributeQueuedJobCount] = ipp.TagInteger
+}
+
+// reportQueued makes p report n queued jobs to Get-Printer-Attributes
+// requests.
+func reportQueued(p *fakePrinter, n int) {
+	p.handle = func(req fakeRequest) *ipp.Response {
+		if req.Operation != ipp.OperationGetPrinterAttributes {
+			return nil
+		}
+		resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+		resp.PrinterAttributes = []ipp.Attributes{{
+			attributeQueuedJobCount: {{Tag: ipp.TagInteger, Name: attributeQueuedJobCount, Value: n}},
+		}}
+		return resp
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(t, poolRoundRobin, newFakePrinter(t), newFakePrinter(t), newFakePrinter(t))
+
+	if m, err := pool.peek(); err != nil || m.printer != "P1" {
+		t.Fatalf("peek() = %v, %v, want P1", m, err)
+	}
+	var got []string
+	for n := 0; n < 4; n++ {
+		m, err := pool.pick(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m.printer)
+	}
+	if want := []string{"P1", "P2", "P3", "P1"}; !slices.Equal(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+
+	// a member that is down or not ready is skipped
+	pool.markDown(pool.members[1], errors.New("unreachable"))
+	notP3 := func(m *poolMember) bool { return m.printer != "P3" }
+	if m, err := pool.pick(notP3); err != nil || m.printer != "P1" {
+		t.Errorf("pick() = %v, %v, want P1", m, err)
+	}
+}
+
+func TestPoolLeastBusy(t *testing.T) {
+	busy, idle, unreachable := newFakePrinter(t), newFakePrinter(t), newFakePrinter(t)
+	reportQueued(busy, 5)
+	reportQueued(idle, 1)
+	unreachable.httpStatus[ipp.OperationGetPrinterAttributes] = http.StatusInternalServerError
+	pool := newTestPool(t, poolLeastBusy, unreachable, busy, idle)
+
+	m, err := pool.pick(nil)
+	if err != nil || m.printer != "P3" {
+		t.Fatalf("pick() = %v, %v, want P3", m, err)
+	}
+
+	// the member that did not answer is down, and not asked again
+	if !time.Now().Before(pool.members[0].downUntil) {
+		t.Error("unreachable member is not down")
+	}
+	if _, err := pool.pick(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(unreachable.received(ipp.OperationGetPrinterAttributes)); n != 1 {
+		t.Errorf("unreachable member got %d requests, want 1", n)
+	}
+
+	// without a ready member the job waits; without an up member it fails
+	if m, err := pool.pick(func(*poolMember) bool { return false }); m != nil || err != nil {
+		t.Errorf("pick() of no ready member = %v, %v", m, err)
+	}
+	for _, m := range pool.members {
+		pool.markDown(m, errors.New("unreachable"))
+	}
+	if _, err := pool.pick(nil); err == nil {
+		t.Error("pick() of no up member succeeded")
+	}
+}
+
+func TestPrintPoolMarkDown(t *testing.T) {
+	tests := []struct {
+		name string
+		// status fails Create-Job of P1 with an HTTP status, or else
+		// with an IPP status
+		status   int
+		ippError bool
+		down     bool
+	}{
+		{"transport error", http.StatusInternalServerError, false, true},
+		{"rejected", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing, other := newFakePrinter(t), newFakePrinter(t)
+			if tt.status != 0 {
+				failing.httpStatus[ipp.OperationCreateJob] = tt.status
+			}
+			if tt.ippError {
+				failing.handle = func(req fakeRequest) *ipp.Response {
+					if req.Operation != ipp.OperationCreateJob {
+						return nil
+					}
+					return ipp.NewResponse(ipp.StatusErrorNotAuthorized, req.RequestId)
+				}
+			}
+			m := newTestManager(t, newFakePrinter(t))
+			m.pool = newTestPool(t, poolRoundRobin, failing, other)
+
+			if err := m.Print(writeUpload(t, m, "a.pdf", testPDF)); err == nil {
+				t.Fatal("Print() to the failing member succeeded")
+			}
+			if down := time.Now().Before(m.pool.members[0].downUntil); down != tt.down {
+				t.Errorf("member down = %v, want %v", down, tt.down)
+			}
+
+			// the next two jobs skip a member that is down
+			for _, name := range []string{"b.pdf", "c.pdf"} {
+				if err := m.Print(writeUpload(t, m, name, testPDF)); err != nil && tt.down {
+					t.Fatalf("Print(%s) error = %v", name, err)
+				}
+			}
+			wantFailing, wantOther := 2, 1
+			if tt.down {
+				wantFailing, wantOther = 1, 2
+			}
+			if n := len(failing.received(ipp.OperationCreateJob)); n != wantFailing {
+				t.Errorf("failing member got %d Create-Job requests, want %d", n, wantFailing)
+			}
+			if n := len(other.received(ipp.OperationCreateJob)); n != wantOther {
+				t.Errorf("other member got %d Create-Job requests, want %d", n, wantOther)
+			}
+		})
+	}
+}
+
+func TestPrintFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		ippError bool
+		// primaryJobs is the number of Create-Job requests the primary
+		// gets, all before the one of the failover printer, if any
+		primaryJobs int
+		failedOver  bool
+	}{
+		{"no retries", 0, false, 1, true},
+		{"retries", 1, false, 2, true},
+		{"rejected", 1, true, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, failover := newFakePrinter(t), newFakePrinter(t)
+			if tt.ippError {
+				primary.handle = func(req fakeRequest) *ipp.Response {
+					if req.Operation != ipp.OperationCreateJob {
+						return nil
+					}
+					return ipp.NewResponse(ipp.StatusErrorNotAuthorized, req.RequestId)
+				}
+			} else {
+				primary.httpStatus[ipp.OperationCreateJob] = http.StatusInternalServerError
+			}
+			primaryJobsBefore := -1
+			failover.handle = func(req fakeRequest) *ipp.Response {
+				if req.Operation == ipp.OperationCreateJob {
+					primaryJobsBefore = len(primary.received(ipp.OperationCreateJob))
+				}
+				return nil
+			}
+			m := newTestManager(t, primary)
+			m.failover = newTestPool(t, poolRoundRobin, failover).members[0]
+			m.failoverRetries = tt.retries
+			// keeps the backoff before the retry below a second
+			m.retryJitter = true
+
+			err := m.Print(writeUpload(t, m, "a.pdf", testPDF))
+			if (err == nil) != tt.failedOver {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			if n := len(primary.received(ipp.OperationCreateJob)); n != tt.primaryJobs {
+				t.Errorf("primary got %d Create-Job requests, want %d", n, tt.primaryJobs)
+			}
+			wantFailover := 0
+			if tt.failedOver {
+				wantFailover = 1
+			}
+			if n := len(failover.received(ipp.OperationCreateJob)); n != wantFailover {
+				t.Errorf("failover got %d Create-Job requests, want %d", n, wantFailover)
+			}
+			if tt.failedOver && primaryJobsBefore != tt.primaryJobs {
+				t.Errorf("failover got the job after %d primary attempts, want %d", primaryJobsBefore, tt.primaryJobs)
+			}
+		})
+	}
+}
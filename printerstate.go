@@ -0,0 +1,217 @@
+package main
+
+import (
+	"github.com/phin1x/go-ipp"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// printerCondition is what the printer state means for submitting the next
+// document.
+type printerCondition int
+
+const (
+	// conditionReady is a printer accepting work.
+	conditionReady printerCondition = iota
+	// conditionBusy is a printer processing another job.
+	conditionBusy
+	// conditionError is a stopped printer, or one reporting a condition
+	// that needs someone to fix it, such as a jam or an empty toner.
+	conditionError
+)
+
+// errorStateReasons are printer-state-reasons that stop printing even when
+// the printer sends them without the "-error" severity suffix.
+var errorStateReasons = []string{
+	"cover-open",
+	"door-open",
+	"input-tray-missing",
+	"marker-supply-empty",
+	"media-empty",
+	"media-jam",
+	"media-needed",
+	"offline",
+	"output-area-full",
+	"paused",
+	"shutdown",
+	"spool-area-full",
+	"toner-empty",
+}
+
+// classifyPrinterState returns the condition of a printer from its
+// printer-state and printer-state-reasons, along with the reasons causing an
+// error. Reasons with the "-report" or "-warning" suffix are informational
+// and never make the printer unusable on their own.
+func classifyPrinterState(attrs ipp.Attributes) (printerCondition, []string) {
+	var faults []string
+	for _, a := range attrs[ipp.AttributePrinterStateReasons] {
+		reason, ok := a.Value.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(reason, "-error") || slices.Contains(errorStateReasons, reason) {
+			faults = append(faults, reason)
+		}
+	}
+
+	state := 0
+	if v := attrs[ipp.AttributePrinterState]; len(v) > 0 {
+		state, _ = v[0].Value.(int)
+	}
+
+	switch {
+	case len(faults) > 0:
+		return conditionError, faults
+	case state == int(ipp.PrinterStateStopped):
+		return conditionError, []string{"stopped"}
+	case state == int(ipp.PrinterStateProcessing):
+		return conditionBusy, nil
+	}
+
+	return conditionReady, nil
+}
+
+// printerHealth holds the condition of every printer jobs are submitted
+// to, by printer URI. It is shared by all copies of the manager.
+type printerHealth struct {
+	mu       sync.Mutex
+	printers map[string]*printerStatus
+}
+
+// printerStatus is the condition of a printer found by the last state check
+// and until when submissions to it are held back because of it.
+type printerStatus struct {
+	mu        sync.Mutex
+	condition printerCondition
+	reasons   []string
+	until     time.Time
+}
+
+// status returns the status of the printer at uri.
+func (h *printerHealth) status(uri string) *printerStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.printers == nil {
+		h.printers = make(map[string]*printerStatus)
+	}
+	s, ok := h.printers[uri]
+	if !ok {
+		s = &printerStatus{}
+		h.printers[uri] = s
+	}
+
+	return s
+}
+
+// Errors returns the reasons of the printer errors found by the last state
+// checks, by printer URI, or nil when no printer was in error. It returns
+// nil on a nil printerHealth.
+func (h *printerHealth) Errors() map[string][]string {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var errs map[string][]string
+	for uri, s := range h.printers {
+		s.mu.Lock()
+		if s.condition == conditionError {
+			if errs == nil {
+				errs = make(map[string][]string)
+			}
+			errs[uri] = slices.Clone(s.reasons)
+		}
+		s.mu.Unlock()
+	}
+
+	return errs
+}
+
+// printerReady checks the state of the printer file is about to be
+// submitted to, the pool or failover member m or the configured printer
+// when m is nil, and reports whether to submit it now. With
+// PRINTER_BUSY_RETRY a busy printer gets no submissions for that long; with
+// PRINTER_ERROR_BACKOFF a printer in error raises an alert once and gets
+// none for that long, without checking its state again in between. Without
+// either the state is not checked. A failed check lets the document
+// through.
+func (i IppPrinterManager) printerReady(file string, m *poolMember) bool {
+	settings := i.settings.Load()
+	if settings.busyRetry <= 0 && settings.errorBackoff <= 0 {
+		return true
+	}
+
+	client, printer, uri := i.client, i.printerName, i.adapter.GetHttpUri("printers", i.printerName)
+	if m != nil {
+		client, printer, uri = m.client, m.printer, m.uri()
+	}
+
+	h := i.health.status(uri)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(h.until) {
+		return false
+	}
+
+	attrs, err := client.GetPrinterAttributes(printer, []string{ipp.AttributePrinterState, ipp.AttributePrinterStateReasons})
+	if err != nil {
+		log.Printf("Failed to read the state of printer %s: %s\n", uri, err)
+		return true
+	}
+
+	condition, reasons := classifyPrinterState(attrs)
+	switch {
+	case condition == conditionError && h.condition != conditionError:
+		log.Printf("ALERT: printer %s reports an error %v\n", uri, reasons)
+	case condition != conditionError && h.condition == conditionError:
+		log.Printf("Printer %s recovered from error\n", uri)
+	}
+	h.condition, h.reasons = condition, reasons
+
+	switch {
+	case condition == conditionBusy && settings.busyRetry > 0:
+		log.Printf("Printer %s is busy, deferring %s for %s\n", uri, file, settings.busyRetry)
+		h.until = now.Add(settings.busyRetry)
+		return false
+	case condition == conditionError && settings.errorBackoff > 0:
+		log.Printf("Printer %s is in error, deferring %s for %s\n", uri, file, settings.errorBackoff)
+		h.until = now.Add(settings.errorBackoff)
+		return false
+	}
+
+	return true
+}
+
+// readyPrinter returns the printer to submit file to and whether to submit
+// it now: the requested pool member target, or else the first member picked
+// by the pool that is ready. Without a pool it is the configured printer,
+// returned as nil, or the failover printer when only that one is ready.
+// When no pool member is available at all it returns the error along with
+// true, so that the job fails like a failed submission.
+func (i IppPrinterManager) readyPrinter(file string, target *poolMember) (*poolMember, bool, error) {
+	switch {
+	case target != nil:
+		return target, i.printerReady(file, target), nil
+	case i.pool != nil:
+		m, err := i.pool.pick(func(m *poolMember) bool { return i.printerReady(file, m) })
+		if err != nil {
+			return nil, true, err
+		}
+		return m, m != nil, nil
+	case i.printerReady(file, nil):
+		return nil, true, nil
+	case i.failover != nil && i.printerReady(file, i.failover):
+		log.Printf("Primary printer is not ready, sending %s to failover printer %s/%s\n", file, i.failover.addr, i.failover.printer)
+		return i.failover, true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/phin1x/go-ipp"
+)
+
+// printerStateAttrs returns printer attributes with state and reasons.
+func printerStateAttrs(state int8, reasons ...string) ipp.Attributes {
+	attrs := ipp.Attributes{
+		ipp.AttributePrinterState: {{Tag: ipp.TagEnum, Name: ipp.AttributePrinterState, Value: int(state)}},
+	}
+	for _, r := range reasons {
+		attrs[ipp.AttributePrinterStateReasons] = append(attrs[ipp.AttributePrinterStateReasons], ipp.Attribute{Tag: ipp.TagKeyword, Name: ipp.AttributePrinterStateReasons, Value: r})
+	}
+
+	return attrs
+}
+
+func TestClassifyPrinterState(t *testing.T) {
+	tests := []struct {
+		name    string
+		attrs   ipp.Attributes
+		want    printerCondition
+		reasons []string
+	}{
+		{"idle", printerStateAttrs(ipp.PrinterStateIdle, "none"), conditionReady, nil},
+		{"processing", printerStateAttrs(ipp.PrinterStateProcessing), conditionBusy, nil},
+		{"warning", printerStateAttrs(ipp.PrinterStateProcessing, "toner-low-warning"), conditionBusy, nil},
+		{"report", printerStateAttrs(ipp.PrinterStateIdle, "media-jam-report"), conditionReady, nil},
+		{"error suffix", printerStateAttrs(ipp.PrinterStateIdle, "toner-low-error"), conditionError, []string{"toner-low-error"}},
+		{"error reason", printerStateAttrs(ipp.PrinterStateProcessing, "media-jam"), conditionError, []string{"media-jam"}},
+		{"stopped", printerStateAttrs(ipp.PrinterStateStopped), conditionError, []string{"stopped"}},
+		{"no state", ipp.Attributes{}, conditionReady, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reasons := classifyPrinterState(tt.attrs)
+			if got != tt.want || !slices.Equal(reasons, tt.reasons) {
+				t.Errorf("classifyPrinterState() = %d %v, want %d %v", got, reasons, tt.want, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestPrinterReady(t *testing.T) {
+	tests := []struct {
+		name         string
+		attrs        ipp.Attributes
+		busyRetry    time.Duration
+		errorBackoff time.Duration
+		ready        bool
+		errors       []string
+	}{
+		{"ready", printerStateAttrs(ipp.PrinterStateIdle), time.Hour, time.Hour, true, nil},
+		{"busy", printerStateAttrs(ipp.PrinterStateProcessing), time.Hour, time.Hour, false, nil},
+		{"busy without retry", printerStateAttrs(ipp.PrinterStateProcessing), 0, time.Hour, true, nil},
+		{"error", printerStateAttrs(ipp.PrinterStateIdle, "media-jam"), time.Hour, time.Hour, false, []string{"media-jam"}},
+		{"error without backoff", printerStateAttrs(ipp.PrinterStateIdle, "media-jam"), time.Hour, 0, true, []string{"media-jam"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePrinter(t)
+			p.handle = func(req fakeRequest) *ipp.Response {
+				if req.Operation != ipp.OperationGetPrinterAttributes {
+					return nil
+				}
+				resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+				resp.PrinterAttributes = []ipp.Attributes{tt.attrs}
+				return resp
+			}
+			m := newTestManager(t, p)
+			m.settings.Store(&jobSettings{busyRetry: tt.busyRetry, errorBackoff: tt.errorBackoff})
+
+			if got := m.printerReady("a.pdf", nil); got != tt.ready {
+				t.Errorf("printerReady() = %v, want %v", got, tt.ready)
+			}
+			if got := m.health.Errors()[m.adapter.GetHttpUri("printers", m.printerName)]; !slices.Equal(got, tt.errors) {
+				t.Errorf("Errors() = %v, want %v", got, tt.errors)
+			}
+
+			// a deferred submission holds back the next ones without
+			// asking the printer again
+			if got := m.printerReady("b.pdf", nil); got != tt.ready {
+				t.Errorf("second printerReady() = %v, want %v", got, tt.ready)
+			}
+			want := 2
+			if !tt.ready {
+				want = 1
+			}
+			if n := len(p.received(ipp.OperationGetPrinterAttributes)); n != want {
+				t.Errorf("got %d state checks, want %d", n, want)
+			}
+		})
+	}
+}
+
+// reportState makes p report state to Get-Printer-Attributes requests.
+func reportState(p *fakePrinter, state int8, reasons ...string) {
+	p.handle = func(req fakeRequest) *ipp.Response {
+		if req.Operation != ipp.OperationGetPrinterAttributes {
+			return nil
+		}
+		resp := ipp.NewResponse(ipp.StatusOk, req.RequestId)
+		resp.PrinterAttributes = []ipp.Attributes{printerStateAttrs(state, reasons...)}
+		return resp
+	}
+}
+
+func TestPrintReadyPrinter(t *testing.T) {
+	tests := []struct {
+		name string
+		// pool makes the other printers a pool instead of the primary
+		// and its failover printer
+		pool   bool
+		states []int8
+		// printed is the printer that gets the job, 0 when it is
+		// deferred
+		printed int
+	}{
+		{"primary ready", false, []int8{ipp.PrinterStateIdle, ipp.PrinterStateIdle}, 1},
+		{"primary busy", false, []int8{ipp.PrinterStateProcessing, ipp.PrinterStateIdle}, 2},
+		{"primary stopped", false, []int8{ipp.PrinterStateStopped, ipp.PrinterStateIdle}, 2},
+		{"both busy", false, []int8{ipp.PrinterStateProcessing, ipp.PrinterStateProcessing}, 0},
+		{"pool member stopped", true, []int8{ipp.PrinterStateStopped, ipp.PrinterStateIdle}, 2},
+		{"pool busy", true, []int8{ipp.PrinterStateProcessing, ipp.PrinterStateStopped}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printers := []*fakePrinter{newFakePrinter(t), newFakePrinter(t)}
+			for n, p := range printers {
+				reportState(p, tt.states[n])
+			}
+			m := newTestManager(t, newFakePrinter(t))
+			if tt.pool {
+				m.pool = newTestPool(t, poolRoundRobin, printers...)
+			} else {
+				m = newTestManager(t, printers[0])
+				m.failover = newTestPool(t, poolRoundRobin, printers[1]).members[0]
+			}
+			m.settings.Store(&jobSettings{busyRetry: time.Hour, errorBackoff: time.Hour})
+
+			file := writeUpload(t, m, "a.pdf", testPDF)
+			if err := m.Print(file); err != nil {
+				t.Fatalf("Print() error = %v", err)
+			}
+
+			for n, p := range printers {
+				want := 0
+				if n == tt.printed-1 {
+					want = 1
+				}
+				if got := len(p.received(ipp.OperationCreateJob)); got != want {
+					t.Errorf("printer %d got %d Create-Job requests, want %d", n+1, got, want)
+				}
+			}
+			if uploads := folderFiles(t, m.uploadPath); (tt.printed == 0) != slices.Contains(uploads, "a.pdf") {
+				t.Errorf("upload folder = %v", uploads)
+			}
+		})
+	}
+}
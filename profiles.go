@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// sidecarProfileKey is the sidecar entry selecting a profile. It is not a
+// job attribute and never sent to the printer.
+const sidecarProfileKey = "profile"
+
+// profileToken matches a profile selected in a file name, for systems that
+// cannot write sidecars: "invoice@profile=draft-duplex.pdf" is printed with
+// the draft-duplex profile.
+var profileToken = regexp.MustCompile(`@profile=([A-Za-z0-9_-]+)`)
+
+// loadProfiles reads the PRINTER_PROFILES_FILE JSON object, which maps
+// profile names to job attributes, e.g.
+// {"draft-duplex": {"sides": "two-sided-long-edge", "print-quality": 3}}.
+func loadProfiles(file string) (map[string]map[string]any, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]map[string]any)
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", file, err)
+	}
+	for _, attrs := range profiles {
+		normalizeAttrs(attrs)
+	}
+
+	return profiles, nil
+}
+
+// profileAttrs returns the attributes of the profile selected for the
+// document named name: by the sidecar, then by a profile token in the name,
+// then PRINTER_PROFILE. The profile entry is removed from sidecarAttrs. It
+// fails for a profile that is not defined.
+func (s *jobSettings) profileAttrs(name string, sidecarAttrs map[string]any) (map[string]any, error) {
+	profile := s.defaultProfile
+	if m := profileToken.FindStringSubmatch(name); m != nil {
+		profile = m[1]
+	}
+	if v, ok := sidecarAttrs[sidecarProfileKey]; ok {
+		delete(sidecarAttrs, sidecarProfileKey)
+		if profile, ok = v.(string); !ok {
+			return nil, fmt.Errorf("invalid profile %v in sidecar", v)
+		}
+	}
+
+	if profile == "" {
+		return nil, nil
+	}
+	attrs, ok := s.profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not defined", profile)
+	}
+
+	return attrs, nil
+}
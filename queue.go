@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// queuedFile describes a file in the upload folder.
+type queuedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Age      float64   `json:"age_seconds"`
+	Type     string    `json:"type,omitempty"`
+	// State is "ready" when the next sweep prints the file, "writing" while
+	// it may still be written to, "submitted" while its job is awaited,
+	// "stuck" when it is not processed again in this run and "unsupported"
+	// for files that are not printed.
+	State string `json:"state"`
+}
+
+// queuedFiles lists the files in the upload folder in the order they are
+// swept. Sidecars, markers and completed files are left out and names are
+// relative to the upload folder.
+func (i IppPrinterManager) queuedFiles() ([]queuedFile, error) {
+	var files []queuedFile
+	now := time.Now()
+	settle := time.Duration(i.stableChecks) * i.stableInterval
+
+	err := filepath.Walk(i.uploadPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || sidecars.has(path) || isCompleted(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(i.uploadPath, path)
+		if err != nil {
+			return err
+		}
+
+		f := queuedFile{
+			Name:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			Age:      now.Sub(info.ModTime()).Seconds(),
+			Type:     detectedType(info.Name()),
+		}
+		switch {
+		case !isPrintable(path):
+			f.State = "unsupported"
+		case i.isAwaiting(path):
+			f.State = "submitted"
+		case i.isStuck(path):
+			f.State = "stuck"
+		case now.Sub(info.ModTime()) < settle:
+			f.State = "writing"
+		default:
+			f.State = "ready"
+		}
+		files = append(files, f)
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return files, err
+}
+
+// detectedType returns the document format of name from its format token
+// or extension, ignoring PRINTER_DOCUMENT_FORMAT.
+func detectedType(name string) string {
+	if format, _, ok := parseFormatToken(name); ok {
+		return format
+	}
+
+	return extensionFormats[strings.ToLower(filepath.Ext(encryptedExt.ReplaceAllString(name, "")))]
+}
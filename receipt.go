@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Formats of the receipts (PRINTER_RECEIPT_FORMAT).
+const (
+	receiptPDF  = "pdf"
+	receiptJSON = "json"
+)
+
+// receipt is the audit record written to the receipts folder for every
+// submitted job when receipts are enabled, as a PDF or as JSON. It is never
+// printed.
+type receipt struct {
+	File       string         `json:"file"`
+	JobID      int            `json:"job_id,omitempty"`
+	Printer    string         `json:"printer,omitempty"`
+	Time       time.Time      `json:"time"`
+	State      string         `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	Checksum   string         `json:"checksum,omitempty"`
+	Ignored    []string       `json:"ignored_attributes,omitempty"`
+	Attributes map[string]any `json:"attributes"`
+}
+
+// writeReceipt records the outcome of submitting file to printer with the
+// job attributes ja, the checksum of the document, if computed, and the
+// attributes the printer ignored or substituted. Failures are logged and do
+// not affect the job.
+func (i IppPrinterManager) writeReceipt(file string, jobID int, printer string, ja map[string]any, sum string, ignored []string, printErr error) {
+	i.saveReceipt(newReceipt(file, jobID, printer, ja, sum, ignored, printErr))
+}
+
+// newReceipt returns the receipt writeReceipt writes, for jobs whose
+// receipt is only written once they are done.
+func newReceipt(file string, jobID int, printer string, ja map[string]any, sum string, ignored []string, printErr error) receipt {
+	r := receipt{
+		File:       filepath.Base(file),
+		JobID:      jobID,
+		Printer:    printer,
+		Time:       time.Now(),
+		State:      "printed",
+		Checksum:   sum,
+		Ignored:    ignored,
+		Attributes: make(map[string]any, len(ja)),
+	}
+	if printErr != nil {
+		r.State = "failed"
+		r.Error = printErr.Error()
+	}
+	for k, v := range ja {
+		if k == attributeDocumentPassword {
+			continue
+		}
+		if op, ok := v.(operationAttr); ok {
+			v = op.value
+		}
+		r.Attributes[k] = v
+	}
+
+	return r
+}
+
+// saveReceipt writes r to the receipts folder when receipts are enabled.
+// Failures are logged.
+func (i IppPrinterManager) saveReceipt(r receipt) {
+	if !i.receipts {
+		return
+	}
+
+	var b []byte
+	if i.receiptFmt == receiptJSON {
+		var err error
+		if b, err = json.MarshalIndent(r, "", "  "); err != nil {
+			log.Printf("Failed to encode receipt for %s: %s\n", r.File, err)
+			return
+		}
+	} else {
+		b = textPDF(r.lines())
+	}
+
+	dst := filepath.Join(i.receiptsPath, fmt.Sprintf("%s_%d_%s.%s", r.Time.Format("2006-01-02T150405.000000"), r.JobID, r.File, i.receiptFmt))
+	if err := os.WriteFile(dst, b, 0644); err != nil {
+		log.Printf("Failed to write receipt for %s: %s\n", r.File, err)
+	}
+}
+
+// lines returns the text of the PDF receipt.
+func (r receipt) lines() []string {
+	lines := []string{
+		"Print receipt",
+		"",
+		"File:      " + r.File,
+		fmt.Sprintf("Job ID:    %d", r.JobID),
+		"Printer:   " + r.Printer,
+		"Time:      " + r.Time.Format(time.RFC3339),
+		"State:     " + r.State,
+	}
+	if r.Error != "" {
+		lines = append(lines, "Error:     "+r.Error)
+	}
+	if r.Checksum != "" {
+		lines = append(lines, "Checksum:  "+r.Checksum)
+	}
+	if len(r.Ignored) > 0 {
+		lines = append(lines, "Ignored:   "+strings.Join(r.Ignored, ", "))
+	}
+
+	lines = append(lines, "", "Attributes:")
+	names := make([]string, 0, len(r.Attributes))
+	for k := range r.Attributes {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	for _, k := range names {
+		v, err := json.Marshal(r.Attributes[k])
+		if err != nil {
+			v = []byte(fmt.Sprint(r.Attributes[k]))
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", k, v))
+	}
+
+	return lines
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// failedPrefix matches the date and reason prefix markFailed adds to files
+// moved to the failed folder.
+var failedPrefix = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_((wrongpassword|expired|io|conversion|transport|rejected|timeout)_)?`)
+
+// retryFailed implements the retry-failed command: it moves documents from
+// the failed folder back into the upload folder, without their failure
+// prefix, and removes ".failed" markers, so the watcher prints them again.
+func retryFailed(rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	filter := fs.String("filter", "*", "only requeue failed files whose name matches this glob")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := filepath.Match(*filter, ""); err != nil {
+		return fmt.Errorf("invalid --filter %q: %w", *filter, err)
+	}
+
+	failedPath := filepath.Join(rootFolder, "failed")
+	uploadPath := filepath.Join(rootFolder, "upload")
+	spool := localStorage{root: rootFolder}
+
+	entries, err := os.ReadDir(failedPath)
+	if err != nil {
+		return err
+	}
+
+	requeued := 0
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !isPrintable(name) {
+			continue
+		}
+		if ok, _ := filepath.Match(*filter, name); !ok {
+			continue
+		}
+
+		src := filepath.Join(failedPath, name)
+		dst, err := spool.Move(path.Join("failed", name), path.Join("upload", failedPrefix.ReplaceAllString(name, "")))
+		if err != nil {
+			return fmt.Errorf("failed to requeue %s: %w", name, err)
+		}
+		sidecars.move(src, filepath.Join(rootFolder, filepath.FromSlash(dst)))
+		fmt.Printf("Requeued %s as %s\n", name, path.Base(dst))
+		requeued++
+	}
+
+	// in mark mode failed files stay in the upload folder next to a marker
+	marked, err := os.ReadDir(uploadPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range marked {
+		name, ok := strings.CutSuffix(e.Name(), markerFailed)
+		if !ok {
+			continue
+		}
+		if ok, _ := filepath.Match(*filter, name); !ok {
+			continue
+		}
+
+		if err := spool.Remove(path.Join("upload", e.Name())); err != nil {
+			return fmt.Errorf("failed to requeue %s: %w", name, err)
+		}
+		fmt.Printf("Requeued %s\n", name)
+		requeued++
+	}
+
+	fmt.Printf("Requeued %d file(s)\n", requeued)
+
+	return nil
+}
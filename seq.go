@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// seqFile holds the last local job sequence number issued, relative to the
+// root folder.
+const seqFile = ".seq"
+
+// nextSeq returns the next local job sequence number and persists it before
+// returning, so numbers are never reused across restarts. The caller must
+// hold i.mu.
+func (i IppPrinterManager) nextSeq() (int, error) {
+	p := filepath.Join(i.rootFolder, seqFile)
+
+	last := 0
+	b, err := os.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if len(b) > 0 {
+		if last, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return 0, fmt.Errorf("corrupt sequence file %s: %w", p, err)
+		}
+	}
+
+	next := last + 1
+	if err := writeFileSync(p, []byte(fmt.Sprintf("%d\n", next))); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// writeFileSync replaces p with data through a synced temporary file, so a
+// crash leaves either the old or the new content.
+func writeFileSync(p string, data []byte) error {
+	tmp := p + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// sidecar is a kind of file kept next to a document and named after it,
+// e.g. "report.pdf.attrs.json".
+type sidecar struct {
+	suffix string
+	// follows is set for sidecars that are moved or deleted along with
+	// their document. Markers describe the document where it is and are
+	// managed by the code writing them.
+	follows bool
+}
+
+// sidecarSet enumerates the sidecars written or read by this tool. None of
+// them is ever printed.
+type sidecarSet []sidecar
+
+// sidecars are the sidecars a document may have. Temporary files of uploads
+// being staged are included so that they are skipped as well.
+var sidecars = sidecarSet{
+	{sidecarAttrsSuffix, true},
+	{passwordSuffix, true},
+	{markerPrinted, false},
+	{markerFailed, false},
+	{markerSubmitted, false},
+	{".tmp", false},
+}
+
+// has reports whether file is a sidecar of s.
+func (s sidecarSet) has(file string) bool {
+	for _, sc := range s {
+		if strings.HasSuffix(file, sc.suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// move moves the sidecars of file that follow it next to newFile.
+func (s sidecarSet) move(file, newFile string) {
+	for _, sc := range s {
+		if !sc.follows {
+			continue
+		}
+		if err := os.Rename(file+sc.suffix, newFile+sc.suffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to move %s sidecar of %s: %s\n", sc.suffix, file, err)
+		}
+	}
+}
+
+// remove deletes the sidecars of file that follow it.
+func (s sidecarSet) remove(file string) {
+	for _, sc := range s {
+		if !sc.follows {
+			continue
+		}
+		if err := os.Remove(file + sc.suffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete %s sidecar of %s: %s\n", sc.suffix, file, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSidecarSetHas(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"a.pdf", false},
+		{"a.pdf.attrs.json", true},
+		{"a.pdf.password", true},
+		{"a.pdf.printed", true},
+		{"a.pdf.failed", true},
+		{"a.pdf.submitted", true},
+		{".a.pdf.123.tmp", true},
+		{"attrs.json.pdf", false},
+	}
+	for _, tt := range tests {
+		if got := sidecars.has(tt.file); got != tt.want {
+			t.Errorf("sidecars.has(%q) = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// storage is the small set of operations needed to keep a spool of
+// documents. Keys are slash separated. The local folders of the manager are
+// a localStorage; object storage is used through a remoteSource.
+type storage interface {
+	List(prefix string) ([]string, error)
+	Open(key string) (io.ReadSeekCloser, error)
+	// Move moves src to dst and returns the key it was stored under, which
+	// differs from dst when the storage never overwrites existing keys.
+	Move(src, dst string) (string, error)
+	Remove(key string) error
+}
+
+// storageBackends holds the storage constructors compiled into the binary,
+// keyed by URL scheme. Object storage backends register themselves from
+// files built with their build tag (s3) to keep their dependencies optional.
+var storageBackends = map[string]func(u *url.URL) (storage, error){
+	"file": func(u *url.URL) (storage, error) {
+		return localStorage{root: u.Path}, nil
+	},
+}
+
+// localStorage implements storage on a local directory tree. Moves never
+// overwrite an existing file, see safeRename.
+type localStorage struct {
+	root string
+}
+
+func (s localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s localStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.path(prefix), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(s.root, p)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return keys, err
+}
+
+func (s localStorage) Open(key string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s localStorage) Move(src, dst string) (string, error) {
+	dstPath := s.path(dst)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return "", err
+	}
+
+	moved, err := safeRename(s.path(src), dstPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.root, moved)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+func (s localStorage) Remove(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// spoolKey returns the key in i.spool of file, a path under the root folder.
+func (i IppPrinterManager) spoolKey(file string) (string, error) {
+	rel, err := filepath.Rel(i.rootFolder, file)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", file, i.rootFolder)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// openSpool opens file, a path under the root folder, from i.spool.
+func (i IppPrinterManager) openSpool(file string) (io.ReadSeekCloser, error) {
+	key, err := i.spoolKey(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.spool.Open(key)
+}
+
+// moveSpool moves file to dst, both paths under the root folder, within
+// i.spool and returns the path it was moved to.
+func (i IppPrinterManager) moveSpool(file, dst string) (string, error) {
+	src, err := i.spoolKey(file)
+	if err != nil {
+		return "", err
+	}
+	dstKey, err := i.spoolKey(dst)
+	if err != nil {
+		return "", err
+	}
+
+	moved, err := i.spool.Move(src, dstKey)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(i.rootFolder, filepath.FromSlash(moved)), nil
+}
+
+// removeSpool deletes file, a path under the root folder, from i.spool.
+func (i IppPrinterManager) removeSpool(file string) error {
+	key, err := i.spoolKey(file)
+	if err != nil {
+		return err
+	}
+
+	return i.spool.Remove(key)
+}
+
+// remoteStateFile holds the state of the remote source, relative to the
+// root folder, so that a restart neither downloads objects again nor
+// forgets the moves still to be made.
+const remoteStateFile = ".remote.json"
+
+// remoteObject is the state of a remote key known to a remoteSource.
+type remoteObject struct {
+	// File is the staged local copy while it is being printed.
+	File string `json:"file,omitempty"`
+	// Dst is the key the object still has to be moved to, once its local
+	// copy was printed or has failed.
+	Dst string `json:"dst,omitempty"`
+
+	// moving is set while a move of the object is in progress, so that
+	// Complete and a retry by Sync never move it at the same time.
+	moving bool
+}
+
+// remoteSource mirrors a spool kept in storage into the local upload folder.
+// Objects under "<prefix>/upload/" are downloaded for printing and, once the
+// local copy is printed or has failed, moved to "<prefix>/printed/" or
+// "<prefix>/failed/" like their local counterparts. A key stays known until
+// its object was moved, so it is never downloaded twice, and the state is
+// persisted in statePath.
+type remoteSource struct {
+	store     storage
+	prefix    string
+	statePath string
+
+	mu      sync.Mutex
+	objects map[string]*remoteObject // remote key -> state
+}
+
+// newRemoteSource parses a PRINTER_SOURCE URL such as s3://bucket/prefix and
+// loads the state saved in statePath.
+func newRemoteSource(source, statePath string) (*remoteSource, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	newStore, ok := storageBackends[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("storage scheme %q is not available in this build", u.Scheme)
+	}
+
+	store, err := newStore(u)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if u.Scheme != "file" {
+		prefix = strings.Trim(u.Path, "/")
+	}
+
+	r := &remoteSource{
+		store:     store,
+		prefix:    prefix,
+		statePath: statePath,
+		objects:   make(map[string]*remoteObject),
+	}
+	b, err := os.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &r.objects); err != nil {
+			return nil, fmt.Errorf("corrupt remote source state %s: %w", statePath, err)
+		}
+	}
+
+	return r, nil
+}
+
+// save persists the state. The caller must hold r.mu.
+func (r *remoteSource) save() {
+	b, err := json.Marshal(r.objects)
+	if err == nil {
+		err = writeFileSync(r.statePath, b)
+	}
+	if err != nil {
+		log.Printf("Failed to save remote source state: %s\n", err)
+	}
+}
+
+// Sync retries the moves that failed before and downloads objects that are
+// not known yet into the upload folder.
+func (r *remoteSource) Sync(ctx context.Context, ipm IppPrinterManager) error {
+	r.retryMoves()
+
+	keys, err := r.store.List(path.Join(r.prefix, "upload") + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		r.mu.Lock()
+		_, known := r.objects[key]
+		r.mu.Unlock()
+		if known || !isPrintable(key) {
+			continue
+		}
+
+		if err := r.download(ipm, key); err != nil {
+			log.Printf("Failed to download %s: %s\n", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *remoteSource) download(ipm IppPrinterManager, key string) error {
+	obj, err := r.store.Open(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	file, err := ipm.stage(path.Base(key), obj, nil)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.objects[key] = &remoteObject{File: file}
+	r.save()
+	r.mu.Unlock()
+
+	log.Printf("Downloaded %s to %s\n", key, file)
+
+	return nil
+}
+
+// Complete moves the remote object behind the staged file to the printed or
+// failed prefix. Files that did not come from the remote source are ignored.
+// A failed move is retried by the next Sync. It is a no-op on a nil source.
+func (r *remoteSource) Complete(file string, printed bool) {
+	if r == nil {
+		return
+	}
+
+	folder := "failed"
+	if printed {
+		folder = "printed"
+	}
+
+	r.mu.Lock()
+	var key string
+	for k, o := range r.objects {
+		if o.File == file {
+			key = k
+			o.File, o.Dst = "", path.Join(r.prefix, folder, path.Base(k))
+			r.save()
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if key != "" {
+		r.move(key)
+	}
+}
+
+// retryMoves makes the moves that failed before.
+func (r *remoteSource) retryMoves() {
+	r.mu.Lock()
+	var keys []string
+	for k, o := range r.objects {
+		if o.Dst != "" {
+			keys = append(keys, k)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, k := range keys {
+		r.move(k)
+	}
+}
+
+// move moves key to its destination and forgets it once that succeeded.
+// Keys already moved, or being moved by another caller, are skipped.
+func (r *remoteSource) move(key string) {
+	r.mu.Lock()
+	o, ok := r.objects[key]
+	if !ok || o.Dst == "" || o.moving {
+		r.mu.Unlock()
+		return
+	}
+	o.moving = true
+	dst := o.Dst
+	r.mu.Unlock()
+
+	if _, err := r.store.Move(key, dst); err != nil {
+		log.Printf("Failed to move %s to %s, retrying later: %s\n", key, dst, err)
+		r.mu.Lock()
+		o.moving = false
+		r.mu.Unlock()
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.objects, key)
+	r.save()
+	r.mu.Unlock()
+}
@@ -0,0 +1,79 @@
+//go:build s3
+
+package main
+
+import (
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+)
+
+func init() {
+	storageBackends["s3"] = newS3Storage
+	// GCS is reached through its S3-compatible XML API
+	storageBackends["gs"] = newS3Storage
+}
+
+// s3Storage implements storage on an S3-compatible bucket. The endpoint can
+// be set with an "endpoint" query parameter (default s3.amazonaws.com, or
+// storage.googleapis.com for gs://), "insecure=true" disables TLS, and
+// credentials come from the standard AWS_ACCESS_KEY_ID /
+// AWS_SECRET_ACCESS_KEY variables.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(u *url.URL) (storage, error) {
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+		if u.Scheme == "gs" {
+			endpoint = "storage.googleapis.com"
+		}
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: u.Query().Get("insecure") != "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Storage{client: client, bucket: u.Host}, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+
+	return keys, nil
+}
+
+func (s *s3Storage) Open(key string) (io.ReadSeekCloser, error) {
+	return s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *s3Storage) Move(src, dst string) (string, error) {
+	_, err := s.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: src},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return dst, s.Remove(src)
+}
+
+func (s *s3Storage) Remove(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStorage is a slow localStorage counting the moves of every key.
+type countingStorage struct {
+	localStorage
+
+	mu    sync.Mutex
+	moves map[string]int
+}
+
+func (s *countingStorage) Move(src, dst string) (string, error) {
+	s.mu.Lock()
+	s.moves[src]++
+	s.mu.Unlock()
+
+	// like a request to object storage, the move takes a while
+	time.Sleep(5 * time.Millisecond)
+
+	return s.localStorage.Move(src, dst)
+}
+
+// newTestRemoteSource returns a remote source on a local directory holding
+// the given keys.
+func newTestRemoteSource(t *testing.T, keys ...string) (*remoteSource, string) {
+	root := t.TempDir()
+	for _, key := range keys {
+		file := filepath.Join(root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(testPDF), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := newRemoteSource("file://"+root, filepath.Join(t.TempDir(), remoteStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, root
+}
+
+func TestRemoteSourceSync(t *testing.T) {
+	m := newTestManager(t, newFakePrinter(t))
+	r, root := newTestRemoteSource(t, "upload/a.pdf", "upload/notes.txt")
+
+	if err := r.Sync(context.Background(), *m); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Sync(context.Background(), *m); err != nil {
+		t.Fatal(err)
+	}
+	if names := folderFiles(t, m.uploadPath); len(names) != 1 || names[0] != "a.pdf" {
+		t.Fatalf("upload folder holds %v, want [a.pdf]", names)
+	}
+
+	// a restart knows a.pdf from the saved state
+	restarted, err := newRemoteSource("file://"+root, r.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Sync(context.Background(), *m); err != nil {
+		t.Fatal(err)
+	}
+	if names := folderFiles(t, m.uploadPath); len(names) != 1 {
+		t.Fatalf("restart downloaded again: %v", names)
+	}
+
+	restarted.Complete(filepath.Join(m.uploadPath, "a.pdf"), true)
+	if _, err := os.Stat(filepath.Join(root, "printed", "a.pdf")); err != nil {
+		t.Errorf("remote object not moved: %s", err)
+	}
+	if len(restarted.objects) != 0 {
+		t.Errorf("still knows %v", restarted.objects)
+	}
+}
+
+func TestRemoteSourceRetriesMoves(t *testing.T) {
+	r, root := newTestRemoteSource(t, "upload/a.pdf")
+	store := &flakyStorage{localStorage: r.store.(localStorage), failures: 1, err: os.ErrPermission}
+	r.store = store
+	r.objects["upload/a.pdf"] = &remoteObject{File: "/upload/a.pdf"}
+
+	r.Complete("/upload/a.pdf", false)
+	if _, ok := r.objects["upload/a.pdf"]; !ok {
+		t.Fatal("failed move forgotten")
+	}
+	r.retryMoves()
+
+	if store.moves != 2 {
+		t.Errorf("%d move attempts, want 2", store.moves)
+	}
+	if _, err := os.Stat(filepath.Join(root, "failed", "a.pdf")); err != nil {
+		t.Errorf("remote object not moved: %s", err)
+	}
+	if len(r.objects) != 0 {
+		t.Errorf("still knows %v", r.objects)
+	}
+}
+
+func TestRemoteSourceConcurrentMoves(t *testing.T) {
+	const objects = 50
+	var keys []string
+	for n := 0; n < objects; n++ {
+		keys = append(keys, fmt.Sprintf("upload/%d.pdf", n))
+	}
+	r, root := newTestRemoteSource(t, keys...)
+	store := &countingStorage{localStorage: r.store.(localStorage), moves: make(map[string]int)}
+	r.store = store
+	for _, key := range keys {
+		r.objects[key] = &remoteObject{File: "/" + key}
+	}
+
+	// the poller completes jobs while the watcher retries moves
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(2)
+		go func(key string) {
+			defer wg.Done()
+			r.Complete("/"+key, true)
+		}(key)
+		go func() {
+			defer wg.Done()
+			r.retryMoves()
+		}()
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		if n := store.moves[key]; n != 1 {
+			t.Errorf("%s moved %d times", key, n)
+		}
+	}
+	if names := folderFiles(t, filepath.Join(root, "printed")); len(names) != objects {
+		t.Errorf("printed holds %d objects, want %d", len(names), objects)
+	}
+	if len(r.objects) != 0 {
+		t.Errorf("still knows %d objects", len(r.objects))
+	}
+}
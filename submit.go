@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"log"
+	"maps"
+)
+
+// errJobMayPrint marks a failed submission whose job the printer created and
+// could not be canceled. Submitting the document again, to any printer,
+// could print it twice.
+var errJobMayPrint = errors.New("an incomplete job was left on the printer and may still print")
+
+// incompleteJobError is the failure of a Send-Document after Create-Job
+// created jobID.
+type incompleteJobError struct {
+	jobID int
+	err   error
+}
+
+func (e *incompleteJobError) Error() string {
+	return fmt.Sprintf("job %d: %s", e.jobID, e.err)
+}
+
+func (e *incompleteJobError) Unwrap() error {
+	return e.err
+}
+
+// printDocuments submits docs as one job to printer, like
+// ipp.IPPClient.PrintDocuments: a Create-Job followed by a Send-Document per
+// document. A failed Send-Document returns an *incompleteJobError, so that
+// the caller knows the printer holds the job.
+func printDocuments(client *ipp.IPPClient, adapter *httpAdapter, docs []ipp.Document, printer string, ja map[string]any) (int, error) {
+	uri := adapter.GetHttpUri("printers", printer)
+
+	req := ipp.NewRequest(ipp.OperationCreateJob, 1)
+	req.OperationAttributes[ipp.AttributePrinterURI] = printerURIPrefix + printer
+	// the defaults of go-ipp, which ja may override
+	req.OperationAttributes[ipp.AttributeJobName] = docs[0].Name
+	req.OperationAttributes[ipp.AttributeCopies] = 1
+	req.OperationAttributes[ipp.AttributeJobPriority] = ipp.DefaultJobPriority
+	maps.Copy(req.JobAttributes, ja)
+
+	resp, err := client.SendRequest(uri, req, nil)
+	if err != nil {
+		return -1, err
+	}
+	if len(resp.JobAttributes) == 0 || len(resp.JobAttributes[0][ipp.AttributeJobID]) == 0 {
+		return 0, errors.New("printer returned no job-id")
+	}
+	jobID, ok := resp.JobAttributes[0][ipp.AttributeJobID][0].Value.(int)
+	if !ok {
+		return 0, errors.New("printer returned an invalid job-id")
+	}
+
+	for n, doc := range docs {
+		req := ipp.NewRequest(ipp.OperationSendDocument, 2)
+		req.OperationAttributes[ipp.AttributePrinterURI] = printerURIPrefix + printer
+		req.OperationAttributes[ipp.AttributeJobID] = jobID
+		req.OperationAttributes[ipp.AttributeDocumentName] = doc.Name
+		req.OperationAttributes[ipp.AttributeDocumentFormat] = doc.MimeType
+		req.OperationAttributes[ipp.AttributeLastDocument] = n == len(docs)-1
+		req.File = doc.Document
+		req.FileSize = doc.Size
+
+		if _, err := client.SendRequest(uri, req, nil); err != nil {
+			return -1, &incompleteJobError{jobID: jobID, err: err}
+		}
+	}
+
+	return jobID, nil
+}
+
+// cancelJob cancels jobID as user.
+func cancelJob(client *ipp.IPPClient, adapter *httpAdapter, jobID int, user string) error {
+	_, err := client.SendRequest(adapter.GetHttpUri("jobs", ""), jobRequest(ipp.OperationCancelJob, jobID, user), nil)
+	return err
+}
+
+// submit submits docs to printer through client and adapter as user. When
+// the printer created the job but a document could not be sent, the
+// incomplete job is canceled; when that fails too, the error wraps
+// errJobMayPrint.
+func submit(client *ipp.IPPClient, adapter *httpAdapter, docs []ipp.Document, printer string, ja map[string]any, user string) (int, error) {
+	jobID, err := printDocuments(client, adapter, docs, printer, ja)
+
+	var incomplete *incompleteJobError
+	if errors.As(err, &incomplete) {
+		if cerr := cancelJob(client, adapter, incomplete.jobID, user); cerr != nil {
+			log.Printf("Failed to cancel incomplete job %d on %s: %s\n", incomplete.jobID, printer, cerr)
+			return -1, fmt.Errorf("%w: %w", errJobMayPrint, err)
+		}
+		log.Printf("Canceled incomplete job %d on %s\n", incomplete.jobID, printer)
+	}
+
+	return jobID, err
+}
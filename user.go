@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	userSourceClient   = "client"
+	userSourceProcess  = "process"
+	userSourceOwner    = "owner"
+	userSourceFilename = "filename"
+)
+
+// filenameUserSep separates the user from the document name in the
+// "filename" user source convention, e.g. "alice__report.pdf".
+const filenameUserSep = "__"
+
+// requestingUser derives the requesting-user-name for file according to
+// userSource. An empty result leaves the client's configured user in place.
+func (i IppPrinterManager) requestingUser(file string) string {
+	switch i.userSource {
+	case userSourceProcess:
+		if u, err := user.Current(); err == nil {
+			return u.Username
+		}
+	case userSourceOwner:
+		info, err := os.Stat(file)
+		if err != nil {
+			return ""
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if u, err := user.LookupId(strconv.Itoa(int(st.Uid))); err == nil {
+				return u.Username
+			}
+			return strconv.Itoa(int(st.Uid))
+		}
+	case userSourceFilename:
+		u, _ := splitFilenameUser(filepath.Base(file))
+		return u
+	}
+
+	return ""
+}
+
+// splitFilenameUser splits "alice__report.pdf" into "alice" and "report.pdf".
+// Names without the separator are returned unchanged with an empty user.
+func splitFilenameUser(name string) (string, string) {
+	u, rest, ok := strings.Cut(name, filenameUserSep)
+	if !ok || u == "" || rest == "" {
+		return "", name
+	}
+
+	return u, rest
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSplitFilenameUser(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		rest string
+	}{
+		{"alice__report.pdf", "alice", "report.pdf"},
+		{"alice__bob__report.pdf", "alice", "bob__report.pdf"},
+		{"report.pdf", "", "report.pdf"},
+		{"__report.pdf", "", "__report.pdf"},
+		{"alice__", "", "alice__"},
+	}
+	for _, tt := range tests {
+		user, rest := splitFilenameUser(tt.name)
+		if user != tt.user || rest != tt.rest {
+			t.Errorf("splitFilenameUser(%q) = %q, %q, want %q, %q", tt.name, user, rest, tt.user, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+// validateJob asks the printer the job goes to, the pool member m or the
+// configured printer when m is nil, with Validate-Job whether it would
+// accept a job with the attributes ja and a first document of docFormat
+// sent with the operation attributes docAttrs. The returned error wraps the
+// printer's ipp.IPPError, whose message names the rejected attribute when
+// the printer reports one.
+func (i IppPrinterManager) validateJob(m *poolMember, ja, docAttrs map[string]any, docFormat string) error {
+	client, adapter, printer := i.client, i.adapter, i.printerName
+	if m != nil {
+		client, adapter, printer = m.client, m.adapter, m.printer
+	}
+
+	req := ipp.NewRequest(ipp.OperationValidateJob, 1)
+	req.OperationAttributes[ipp.AttributePrinterURI] = fmt.Sprintf("ipp://localhost/printers/%s", printer)
+	req.OperationAttributes[ipp.AttributeDocumentFormat] = docFormat
+	maps.Copy(req.OperationAttributes, docAttrs)
+	maps.Copy(req.JobAttributes, ja)
+
+	if _, err := client.SendRequest(adapter.GetHttpUri("printers", printer), req, nil); err != nil {
+		return fmt.Errorf("job rejected by Validate-Job: %w", err)
+	}
+
+	return nil
+}
+
+// validationReport tells whether a document would be printed, and which of
+// its attributes would be left out.
+type validationReport struct {
+	Printable bool     `json:"printable"`
+	Format    string   `json:"document_format,omitempty"`
+	Ignored   []string `json:"ignored,omitempty"`
+	Issues    []string `json:"issues,omitempty"`
+}
+
+// validateDocument makes the checks Print makes before submitting file with
+// the sidecar attributes attrs, including Validate-Job when it is enabled,
+// without printing it.
+func (i IppPrinterManager) validateDocument(file string, attrs map[string]any) validationReport {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var report validationReport
+	fail := func(err error) validationReport {
+		report.Issues = append(report.Issues, err.Error())
+		return report
+	}
+
+	name := filepath.Base(file)
+	if !isPrintable(name) {
+		return fail(fmt.Errorf("%s is not a supported document type", name))
+	}
+	fileName := encryptedExt.ReplaceAllString(name, "")
+	report.Format = i.documentFormat(fileName)
+
+	// the content of encrypted documents is only checked when printing
+	var xmpAttrs map[string]any
+	if isPDF(fileName) && fileName == name {
+		r, err := os.Open(file)
+		if err != nil {
+			return fail(err)
+		}
+		defer r.Close()
+
+		if _, err := skipToPDFHeader(r); err != nil {
+			return fail(err)
+		}
+		complete, err := hasPDFTrailer(r)
+		if err != nil {
+			return fail(err)
+		}
+		if !complete {
+			return fail(fmt.Errorf("%s is truncated: no %%%%EOF marker", fileName))
+		}
+		if i.readXMP {
+			if xmpAttrs, err = readXMPAttrs(r); err != nil {
+				return fail(fmt.Errorf("invalid XMP metadata: %w", err))
+			}
+		}
+	}
+
+	target, err := i.sidecarPrinter(attrs)
+	if err != nil {
+		return fail(err)
+	}
+	takeSidecarKey(attrs)
+	ja, ignored, err := i.jobAttrs(file, fileName, xmpAttrs, attrs)
+	if err != nil {
+		return fail(err)
+	}
+	report.Ignored = ignored
+
+	if i.validate {
+		m := target
+		if m == nil && i.pool != nil {
+			if m, err = i.pool.peek(); err != nil {
+				return fail(err)
+			}
+		}
+		adapter := i.adapter
+		if m != nil {
+			adapter = m.adapter
+		}
+		adapter.takeWarnings()
+		if err := i.validateJob(m, ja, documentAttrs(ja), report.Format); err != nil {
+			return fail(err)
+		}
+		warnings := adapter.takeWarnings()
+		report.Ignored = append(report.Ignored, ignoredAttrs(warnings)...)
+		if i.warnAsError && len(warnings) > 0 {
+			return fail(warnings[0])
+		}
+	}
+
+	report.Printable = true
+	return report
+}
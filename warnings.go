@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/phin1x/go-ipp"
+	"slices"
+	"strings"
+)
+
+// maxIppStatusOk is the last status code of the successful range. Codes
+// above StatusOk, such as successful-ok-ignored-or-substituted-attributes,
+// mean the request was accepted with warnings.
+const maxIppStatusOk = 0x00ff
+
+// ippWarning is a successful response to a job request that carried a
+// warning status, with the attributes the printer ignored or substituted.
+type ippWarning struct {
+	status      int16
+	unsupported []string
+}
+
+func (w ippWarning) Error() string {
+	if len(w.unsupported) == 0 {
+		return fmt.Sprintf("printer accepted the job with status 0x%04x", w.status)
+	}
+
+	return fmt.Sprintf("printer accepted the job with status 0x%04x, ignoring or substituting %s", w.status, strings.Join(w.unsupported, ", "))
+}
+
+// maxPendingWarnings bounds the warnings kept by an adapter whose warnings
+// are never taken, such as those of pool members.
+const maxPendingWarnings = 16
+
+// recordWarning keeps the warning of a response to a job request until it
+// is taken by takeWarnings. Other requests, e.g. from the job poller, are
+// ignored.
+func (h *httpAdapter) recordWarning(req *ipp.Request, w ippWarning) {
+	switch req.Operation {
+	case ipp.OperationPrintJob, ipp.OperationCreateJob, ipp.OperationSendDocument, ipp.OperationValidateJob:
+	default:
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.warnings = append(h.warnings, w)
+	if len(h.warnings) > maxPendingWarnings {
+		h.warnings = h.warnings[1:]
+	}
+}
+
+// takeWarnings returns and clears the recorded warnings. It returns nil on
+// a nil adapter.
+func (h *httpAdapter) takeWarnings() []ippWarning {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := h.warnings
+	h.warnings = nil
+	return w
+}
+
+// ignoredAttrs returns the attribute names listed by warnings, without
+// repetitions.
+func ignoredAttrs(warnings []ippWarning) []string {
+	var names []string
+	for _, w := range warnings {
+		for _, n := range w.unsupported {
+			if !slices.Contains(names, n) {
+				names = append(names, n)
+			}
+		}
+	}
+
+	return names
+}
+
+// splitUnsupportedGroup removes the unsupported-attributes group, which the
+// go-ipp decoder cannot parse, from the encoded response b and returns the
+// names of the attributes it listed.
+func splitUnsupportedGroup(b []byte) ([]byte, []string, error) {
+	if len(b) < 8 {
+		return b, nil, nil
+	}
+
+	out := append([]byte(nil), b[:8]...)
+	var names []string
+	unsupported := false
+	for p := 8; p < len(b); {
+		tag := b[p]
+		if tag < 0x10 {
+			// a delimiter tag begins a group or, for the end tag, ends the
+			// attributes and is followed by the document data, if any
+			if tag == byte(ipp.TagEnd) {
+				return append(out, b[p:]...), names, nil
+			}
+			unsupported = tag == byte(ipp.TagUnsupportedGroup)
+			if !unsupported {
+				out = append(out, tag)
+			}
+			p++
+			continue
+		}
+
+		if p+3 > len(b) {
+			return nil, nil, errTruncatedResponse
+		}
+		nameEnd := p + 3 + int(binary.BigEndian.Uint16(b[p+1:]))
+		if nameEnd+2 > len(b) {
+			return nil, nil, errTruncatedResponse
+		}
+		end := nameEnd + 2 + int(binary.BigEndian.Uint16(b[nameEnd:]))
+		if end > len(b) {
+			return nil, nil, errTruncatedResponse
+		}
+
+		if !unsupported {
+			out = append(out, b[p:end]...)
+		} else if name := string(b[p+3 : nameEnd]); name != "" {
+			names = append(names, name)
+		}
+		p = end
+	}
+
+	return out, names, nil
+}
+
+var errTruncatedResponse = errors.New("truncated IPP response")
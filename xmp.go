@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"github.com/phin1x/go-ipp"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// xmpPrintNS is the XMP namespace of the print intent read with
+// PRINTER_READ_XMP. Properties may be written as attributes or elements of
+// an rdf:Description, e.g.
+//
+//	<rdf:Description xmlns:print="http://ns.go-ipp-file-print/print/1.0/"
+//	    print:copies="2" print:media="iso_a4_210x297mm"
+//	    print:sides="two-sided-long-edge"/>
+const xmpPrintNS = "http://ns.go-ipp-file-print/print/1.0/"
+
+// xmpPrintKeys lists the supported properties. Each is named after the job
+// attribute it sets; numeric values are sent as integers.
+var xmpPrintKeys = []string{
+	ipp.AttributeCopies,
+	ipp.AttributeMedia,
+	attributeSides,
+	ipp.AttributeNumberUp,
+	ipp.AttributePrintQuality,
+	attributePrintColorMode,
+	attributeOutputBin,
+}
+
+// xmpMaxPacket bounds the size of an XMP packet kept in memory while
+// scanning a document.
+const xmpMaxPacket = 1 << 20
+
+var (
+	xmpStart = []byte("<x:xmpmeta")
+	xmpEnd   = []byte("</x:xmpmeta>")
+)
+
+// readXMPAttrs scans r for the first uncompressed XMP packet declaring
+// properties in xmpPrintNS and returns them as job attributes. PDF metadata
+// streams are normally stored uncompressed so that tools can find them this
+// way. The position of r is preserved.
+func readXMPAttrs(r io.ReadSeeker) (map[string]any, error) {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := scanXMP(r)
+	if _, serr := r.Seek(pos, io.SeekStart); serr != nil {
+		return nil, serr
+	}
+
+	return attrs, err
+}
+
+func scanXMP(r io.Reader) (map[string]any, error) {
+	var buf []byte
+	chunk := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		for {
+			start := bytes.Index(buf, xmpStart)
+			if start < 0 {
+				// keep enough to match a marker split across reads
+				buf = buf[max(0, len(buf)-len(xmpStart)):]
+				break
+			}
+			end := bytes.Index(buf[start:], xmpEnd)
+			if end < 0 {
+				buf = buf[start:]
+				if len(buf) > xmpMaxPacket {
+					buf = buf[len(xmpStart):]
+					continue
+				}
+				break
+			}
+
+			packet := buf[start : start+end+len(xmpEnd)]
+			buf = buf[start+end+len(xmpEnd):]
+			if !bytes.Contains(packet, []byte(xmpPrintNS)) {
+				continue
+			}
+
+			return parseXMP(packet)
+		}
+
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseXMP returns the xmpPrintNS properties of an XMP packet.
+func parseXMP(packet []byte) (map[string]any, error) {
+	attrs := make(map[string]any)
+	set := func(name, value string) {
+		if !slices.Contains(xmpPrintKeys, name) {
+			return
+		}
+		value = strings.TrimSpace(value)
+		if n, err := strconv.Atoi(value); err == nil {
+			attrs[name] = n
+		} else {
+			attrs[name] = value
+		}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return attrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, a := range se.Attr {
+			if a.Name.Space == xmpPrintNS {
+				set(a.Name.Local, a.Value)
+			}
+		}
+		if se.Name.Space == xmpPrintNS {
+			var value string
+			if err := d.DecodeElement(&value, &se); err != nil {
+				return nil, err
+			}
+			set(se.Name.Local, value)
+		}
+	}
+}